@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AppConfig describes a GitHub App and the owners it dispenses tokens for.
+// Owner may be an exact owner name or a wildcard pattern such as "acme-*".
+// Only '*' wildcards are supported, so that overlapping patterns can be
+// detected.
+// The app's JWTs are signed using exactly one of the private key sources. A
+// signing command is split on whitespace, without support for quoting.
+type AppConfig struct {
+	Owner          string `yaml:"owner"`
+	AppID          int64  `yaml:"app_id"`
+	PrivateKeyFile string `yaml:"private_key_file"`
+	PrivateKeyEnv  string `yaml:"private_key_env"`
+	SigningCommand string `yaml:"signing_command"`
+}
+
+func LoadAppConfigs(file string) ([]AppConfig, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read file '%s': %w", file, err)
+	}
+
+	var configs []AppConfig
+	if err := yaml.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("couldn't parse file '%s': %w", file, err)
+	}
+
+	return configs, nil
+}
+
+// AppRegistry routes a repository owner to the GitHub App that serves it.
+// Exact owner entries take precedence over patterns; patterns must not
+// overlap, so that every owner resolves to at most one app.
+type AppRegistry struct {
+	exact    map[string]*GitHubAppClient
+	patterns []appRoute
+}
+
+var ownerPatternRegexp = regexp.MustCompile(`^[a-z0-9*-]+$`)
+
+type appRoute struct {
+	pattern  string
+	wildcard Wildcard
+	client   *GitHubAppClient
+}
+
+func NewAppRegistry(configs []AppConfig, newClient func(AppConfig) (*GitHubAppClient, error)) (*AppRegistry, error) {
+	registry := &AppRegistry{
+		exact: map[string]*GitHubAppClient{},
+	}
+
+	for _, config := range configs {
+		owner := strings.ToLower(config.Owner)
+		if owner == "" {
+			return nil, fmt.Errorf("app %d must have an owner", config.AppID)
+		}
+
+		if !ownerPatternRegexp.MatchString(owner) {
+			return nil, fmt.Errorf("invalid owner '%s' for app %d; may only contain letters, digits, '-' and '*' wildcards", config.Owner, config.AppID)
+		}
+
+		var wildcard Wildcard
+		isPattern := strings.Contains(owner, "*")
+		if isPattern {
+			var err error
+			wildcard, err = ParseWildcard(owner)
+			if err != nil {
+				return nil, fmt.Errorf("invalid owner pattern: %w", err)
+			}
+
+			for _, route := range registry.patterns {
+				if globsOverlap(route.pattern, owner) {
+					return nil, fmt.Errorf("owner pattern '%s' overlaps with '%s'", config.Owner, route.pattern)
+				}
+			}
+		} else if _, ok := registry.exact[owner]; ok {
+			return nil, fmt.Errorf("owner '%s' is configured for more than one app", config.Owner)
+		}
+
+		client, err := newClient(config)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create client for app %d: %w", config.AppID, err)
+		}
+
+		if isPattern {
+			registry.patterns = append(registry.patterns, appRoute{
+				pattern:  owner,
+				wildcard: wildcard,
+				client:   client,
+			})
+		} else {
+			registry.exact[owner] = client
+		}
+	}
+
+	return registry, nil
+}
+
+// ClientForOwner returns the client for the app that serves an owner.
+func (registry *AppRegistry) ClientForOwner(owner string) (*GitHubAppClient, error) {
+	owner = strings.ToLower(owner)
+
+	if client, ok := registry.exact[owner]; ok {
+		return client, nil
+	}
+
+	for _, route := range registry.patterns {
+		if route.wildcard.Matches(owner) {
+			return route.client, nil
+		}
+	}
+
+	return nil, ErrNoAppForOwner.New(WithWrappedError(fmt.Errorf("owner '%s'", owner)))
+}
+
+// Clients returns every client in the registry.
+func (registry *AppRegistry) Clients() []*GitHubAppClient {
+	var clients []*GitHubAppClient
+	for _, client := range registry.exact {
+		clients = append(clients, client)
+	}
+
+	for _, route := range registry.patterns {
+		clients = append(clients, route.client)
+	}
+
+	return clients
+}
+
+// globsOverlap reports whether there is any string matched by both of two
+// patterns that only use '*' wildcards.
+func globsOverlap(a, b string) bool {
+	if a == "" && b == "" {
+		return true
+	}
+
+	if a != "" && a[0] == '*' {
+		return globsOverlap(a[1:], b) || (b != "" && globsOverlap(a, b[1:]))
+	}
+
+	if b != "" && b[0] == '*' {
+		return globsOverlap(a, b[1:]) || (a != "" && globsOverlap(a[1:], b))
+	}
+
+	if a == "" || b == "" || a[0] != b[0] {
+		return false
+	}
+
+	return globsOverlap(a[1:], b[1:])
+}
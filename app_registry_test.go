@@ -0,0 +1,153 @@
+package main
+
+import "testing"
+
+func TestNewAppRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []AppConfig
+		wantErr bool
+	}{
+		{
+			name: "Accepts exact owners and non-overlapping patterns",
+			configs: []AppConfig{
+				{Owner: "terrabitz", AppID: 1},
+				{Owner: "terrabitz-*", AppID: 2},
+				{Owner: "example-*", AppID: 3},
+			},
+		},
+		{
+			name: "Allows an exact owner that is also matched by a pattern",
+			configs: []AppConfig{
+				{Owner: "terrabitz-forks", AppID: 1},
+				{Owner: "terrabitz-*", AppID: 2},
+			},
+		},
+		{
+			name: "Rejects duplicate exact owners",
+			configs: []AppConfig{
+				{Owner: "terrabitz", AppID: 1},
+				{Owner: "Terrabitz", AppID: 2},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Rejects overlapping patterns",
+			configs: []AppConfig{
+				{Owner: "terrabitz-*", AppID: 1},
+				{Owner: "*-forks", AppID: 2},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Rejects a negated owner pattern",
+			configs: []AppConfig{
+				{Owner: "!acme-*", AppID: 1},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Rejects owner patterns with wildcards other than '*'",
+			configs: []AppConfig{
+				{Owner: "acme-?", AppID: 1},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Rejects regular expression owner patterns",
+			configs: []AppConfig{
+				{Owner: "re:acme-.*", AppID: 1},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Rejects a missing owner",
+			configs: []AppConfig{
+				{AppID: 1},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAppRegistry(tt.configs, newFakeAppClient)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAppRegistry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAppRegistry_ClientForOwner(t *testing.T) {
+	configs := []AppConfig{
+		{Owner: "terrabitz-forks", AppID: 1},
+		{Owner: "terrabitz-*", AppID: 2},
+	}
+
+	registry, err := NewAppRegistry(configs, newFakeAppClient)
+	if err != nil {
+		t.Fatalf("NewAppRegistry() error = %v", err)
+	}
+
+	clientIDs := map[*GitHubAppClient]int64{}
+	for _, config := range configs {
+		client, err := registry.ClientForOwner(config.Owner)
+		if err != nil {
+			t.Fatalf("ClientForOwner() error = %v", err)
+		}
+		clientIDs[client] = config.AppID
+	}
+
+	tests := []struct {
+		owner     string
+		wantAppID int64
+		wantErr   bool
+	}{
+		{owner: "terrabitz-forks", wantAppID: 1},
+		{owner: "terrabitz-tools", wantAppID: 2},
+		{owner: "example", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.owner, func(t *testing.T) {
+			client, err := registry.ClientForOwner(tt.owner)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ClientForOwner() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ClientForOwner() error = %v", err)
+			}
+			if got := clientIDs[client]; got != tt.wantAppID {
+				t.Errorf("ClientForOwner() routed to app %d, want %d", got, tt.wantAppID)
+			}
+		})
+	}
+}
+
+func Test_globsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "foo", b: "foo", want: true},
+		{a: "foo", b: "bar", want: false},
+		{a: "foo-*", b: "foo-bar", want: true},
+		{a: "foo-*", b: "bar-*", want: false},
+		{a: "foo-*", b: "*-bar", want: true},
+		{a: "*", b: "anything", want: true},
+		{a: "a*c", b: "ab*d", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			if got := globsOverlap(tt.a, tt.b); got != tt.want {
+				t.Errorf("globsOverlap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newFakeAppClient(AppConfig) (*GitHubAppClient, error) {
+	return newGitHubAppClient(nil, 0, Args{}), nil
+}
@@ -3,9 +3,10 @@ package main
 import (
 	"context"
 	"fmt"
-	"os"
-
-	"gopkg.in/yaml.v3"
+	"math"
+	"sort"
+	"strings"
+	"time"
 )
 
 type MemRuleRepository struct{}
@@ -13,6 +14,7 @@ type MemRuleRepository struct{}
 func (_ MemRuleRepository) GetRulesForRepo(_ context.Context, repo Repository) ([]AuthorizationRule, error) {
 	rules := map[string][]AuthorizationRule{
 		"terrabitz/goreleaser-test": {{
+			ID: DefaultRuleID("terrabitz/goreleaser-test", 0),
 			Claims: map[GitHubClaimName][]Wildcard{
 				"sub":              NewWildcards("repo:terrabitz/goreleaser-test:*"),
 				"job_workflow_ref": NewWildcards("terrabitz/goreleaser-test/.github/workflows/send-oidc-token.yaml@*"),
@@ -31,58 +33,185 @@ func (_ MemRuleRepository) GetRulesForRepo(_ context.Context, repo Repository) (
 	return rule, nil
 }
 
+// MultiRuleRepository combines the rules of several rule repositories. Since
+// deny rules always take precedence, a deny from any of them blocks a request,
+// and a source that fails to return rules fails the whole request.
+type MultiRuleRepository struct {
+	Sources []AuthRuleRepository
+}
+
+func (mrr MultiRuleRepository) GetRulesForRepo(ctx context.Context, repo Repository) ([]AuthorizationRule, error) {
+	var rules []AuthorizationRule
+	for _, authRules := range mrr.Sources {
+		repoRules, err := authRules.GetRulesForRepo(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, repoRules...)
+	}
+
+	return rules, nil
+}
+
+// FileRuleRepository serves rules loaded from a YAML file. Rules are keyed by
+// repository, where a key is either an exact repository name such as
+// "terrabitz/foo" or a wildcard pattern such as "terrabitz/service-*". An
+// owner-wide default can be set with "terrabitz/*".
+//
+// When several keys match a repository, the most specific one takes
+// precedence: the exact key first, then patterns from most to least specific,
+// where patterns with more literal characters are more specific. Its allow
+// rules replace those of less specific keys, so that e.g. "terrabitz/foo" can
+// grant less than "terrabitz/*". A key with only deny rules doesn't take
+// precedence, and deny rules from every matching key always apply. Patterns
+// that are equally specific combine their allow rules.
 type FileRuleRepository struct {
 	RepoRules map[string][]AuthorizationRule
+
+	repoPatterns []repoKeyPattern
+	files        []string
 }
 
-type FileRuleRepositoryConfig struct {
-	RepoRules map[string][]struct {
-		Claims      map[string]SingleOrMulti `yaml:"claims"`
-		Permissions PermissionSet            `yaml:"permissions"`
-	} `yaml:"repo_rules,inline"`
+type repoKeyPattern struct {
+	key      string
+	wildcard Wildcard
+	literals int
 }
 
+// NewFileRuleRepository loads rules from a YAML file, along with any files it
+// includes. Rules may only use the well-known claims. Loading is strict:
+// unknown fields, malformed keys, invalid patterns and permissions are all
+// rejected with a *RulesFileError pointing at the offending line.
 func NewFileRuleRepository(file string) (FileRuleRepository, error) {
-	b, err := os.ReadFile(file)
-	if err != nil {
-		return FileRuleRepository{}, fmt.Errorf("couldn't read file '%s': %w", file, err)
+	return LoadFileRuleRepository([]string{file}, nil)
+}
+
+// ExpiredRules returns the rules that will never apply again after a given
+// time.
+func (frr FileRuleRepository) ExpiredRules(t time.Time) []AuthorizationRule {
+	var expired []AuthorizationRule
+	for _, key := range sortedKeys(frr.RepoRules) {
+		expired = append(expired, Filter(frr.RepoRules[key], func(rule AuthorizationRule) bool {
+			return rule.IsExpired(t)
+		})...)
 	}
 
-	var config FileRuleRepositoryConfig
-	yaml.Unmarshal(b, &config)
+	return expired
+}
 
-	frr := FileRuleRepository{
-		RepoRules: map[string][]AuthorizationRule{},
+// logExpiredRules reports rules that have expired, so that they can be
+// cleaned up.
+func logExpiredRules(expired []AuthorizationRule) {
+	for _, rule := range expired {
+		fmt.Printf("rule '%s' at %s expired at %s and no longer applies\n", rule.ID, rule.Source, rule.NotAfter.Format(time.RFC3339))
 	}
-	for repo, rules := range config.RepoRules {
-		var authRules []AuthorizationRule
-		for _, rule := range rules {
-			claims := map[GitHubClaimName][]Wildcard{}
-			for claim, values := range rule.Claims {
-				var wildcards []Wildcard
-				for _, value := range values {
-					wildcards = append(wildcards, NewWildcard(value))
-				}
+}
 
-				claimField, err := NewGitHubClaimsField(claim)
-				if err != nil {
-					return FileRuleRepository{}, err
-				}
+// SourceFiles returns every file the rules were loaded from.
+func (frr FileRuleRepository) SourceFiles() []string {
+	return frr.files
+}
+
+// compileRepoPatterns validates every repository key and collects the ones
+// that are patterns, sorted by specificity.
+func (frr *FileRuleRepository) compileRepoPatterns() error {
+	patterns, err := compileRepoKeyPatterns(Keys(frr.RepoRules))
+	if err != nil {
+		return err
+	}
+
+	frr.repoPatterns = patterns
+
+	return nil
+}
+
+// compileRepoKeyPatterns returns the pattern keys among a set of repository
+// keys, from most to least specific.
+func compileRepoKeyPatterns(keys []string) ([]repoKeyPattern, error) {
+	var patterns []repoKeyPattern
 
-				claims[claimField] = wildcards
+	for _, key := range keys {
+		if _, err := ParseRepository(key); err != nil {
+			return nil, fmt.Errorf("invalid repository key: %w", err)
+		}
+
+		if isGlob(key) {
+			wildcard, err := ParseWildcard(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid repository key: %w", err)
 			}
 
-			authRules = append(authRules, AuthorizationRule{
-				Claims:      claims,
-				Permissions: rule.Permissions,
+			patterns = append(patterns, repoKeyPattern{
+				key:      key,
+				wildcard: wildcard,
+				literals: patternLiterals(key),
 			})
 		}
-		frr.RepoRules[repo] = authRules
 	}
 
-	return frr, nil
+	sort.Slice(patterns, func(i, j int) bool {
+		a, b := patterns[i], patterns[j]
+		if a.literals != b.literals {
+			return a.literals > b.literals
+		}
+
+		return a.key < b.key
+	})
+
+	return patterns, nil
+}
+
+// patternLiterals counts the characters of a pattern that only match
+// themselves, i.e. that aren't wildcards or part of a character class.
+func patternLiterals(pattern string) int {
+	literals := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+		case '[':
+			// A ']' right after the '[' is part of the class
+			if i+2 <= len(pattern) {
+				if end := strings.IndexByte(pattern[i+2:], ']'); end >= 0 {
+					i += end + 2
+				}
+			}
+		default:
+			literals++
+		}
+	}
+
+	return literals
 }
 
 func (frr FileRuleRepository) GetRulesForRepo(_ context.Context, repo Repository) ([]AuthorizationRule, error) {
-	return frr.RepoRules[repo.FullName], nil
+	isDeny := func(rule AuthorizationRule) bool { return rule.Deny }
+	isAllow := func(rule AuthorizationRule) bool { return !rule.Deny }
+
+	rules := append([]AuthorizationRule(nil), frr.RepoRules[repo.FullName]...)
+
+	// The exact key is more specific than any pattern.
+	precedence := -1
+	if Any(rules, isAllow) {
+		precedence = math.MaxInt
+	}
+
+	for _, pattern := range frr.repoPatterns {
+		if !pattern.wildcard.Matches(repo.FullName) {
+			continue
+		}
+
+		patternRules := frr.RepoRules[pattern.key]
+		if precedence == -1 && Any(patternRules, isAllow) {
+			precedence = pattern.literals
+		}
+
+		if pattern.literals != precedence {
+			patternRules = Filter(patternRules, isDeny)
+		}
+
+		rules = append(rules, patternRules...)
+	}
+
+	return rules, nil
 }
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 )
 
-// FIXME add permissions
 func TestNewFileRuleRepository(t *testing.T) {
 	type args struct {
 		file string
@@ -25,16 +27,30 @@ func TestNewFileRuleRepository(t *testing.T) {
 			want: FileRuleRepository{
 				RepoRules: map[string][]AuthorizationRule{
 					"terrabitz/foo": {
-						{Claims: map[GitHubClaimName][]Wildcard{
-							"sub":         NewWildcards("repo:terrabitz/*"),
-							"environment": NewWildcards("prod"),
-						}},
+						{
+							ID:     DefaultRuleID("terrabitz/foo", 0),
+							Source: "./testdata/auth_rule.yaml:2:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"sub":         NewWildcards("repo:terrabitz/*"),
+								"environment": NewWildcards("prod"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelRead,
+							},
+						},
 					},
 					"terrabitz/bar": {
-						{Claims: map[GitHubClaimName][]Wildcard{
-							"sub":         NewWildcards("repo:terrabitz/foo"),
-							"environment": NewWildcards("dev", "prod"),
-						}},
+						{
+							ID:     DefaultRuleID("terrabitz/bar", 0),
+							Source: "./testdata/auth_rule.yaml:9:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"sub":         NewWildcards("repo:terrabitz/foo"),
+								"environment": NewWildcards("dev", "prod"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelWrite,
+							},
+						},
 					},
 				},
 			},
@@ -47,20 +63,237 @@ func TestNewFileRuleRepository(t *testing.T) {
 			want: FileRuleRepository{
 				RepoRules: map[string][]AuthorizationRule{
 					"terrabitz/foo": {
-						{Claims: map[GitHubClaimName][]Wildcard{
-							"sub":         NewWildcards("repo:terrabitz/*"),
-							"environment": NewWildcards("prod"),
-						}},
+						{
+							ID:     DefaultRuleID("terrabitz/foo", 0),
+							Source: "./testdata/auth_rule_single.yaml:2:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"sub":         NewWildcards("repo:terrabitz/*"),
+								"environment": NewWildcards("prod"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelRead,
+							},
+						},
 					},
 					"terrabitz/bar": {
-						{Claims: map[GitHubClaimName][]Wildcard{
-							"sub":         NewWildcards("repo:terrabitz/foo"),
-							"environment": NewWildcards("dev", "prod"),
-						}},
+						{
+							ID:     DefaultRuleID("terrabitz/bar", 0),
+							Source: "./testdata/auth_rule_single.yaml:9:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"sub":         NewWildcards("repo:terrabitz/foo"),
+								"environment": NewWildcards("dev", "prod"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelWrite,
+							},
+						},
 					},
 				},
 			},
 		},
+		{
+			name: "Parses deny rules",
+			args: args{
+				file: "./testdata/auth_rule_deny.yaml",
+			},
+			want: FileRuleRepository{
+				RepoRules: map[string][]AuthorizationRule{
+					"terrabitz/foo": {
+						{
+							ID:     DefaultRuleID("terrabitz/foo", 0),
+							Source: "./testdata/auth_rule_deny.yaml:2:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"sub": NewWildcards("repo:terrabitz/*"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelWrite,
+							},
+						},
+					},
+					"*/*": {
+						{
+							ID:     DefaultRuleID("*/*", 0),
+							Source: "./testdata/auth_rule_deny.yaml:8:5",
+							Deny:   true,
+							Claims: map[GitHubClaimName][]Wildcard{
+								"event_name": NewWildcards("pull_request"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelWrite,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "Resolves claim sets and permission presets",
+			args: args{
+				file: "./testdata/auth_rule_definitions.yaml",
+			},
+			want: FileRuleRepository{
+				RepoRules: map[string][]AuthorizationRule{
+					"terrabitz/foo": {
+						{
+							ID:     DefaultRuleID("terrabitz/foo", 0),
+							Source: "./testdata/auth_rule_definitions.yaml:18:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"job_workflow_ref": NewWildcards("terrabitz/workflows/.github/workflows/release.yaml@*"),
+								"sub":              NewWildcards("repo:terrabitz/*"),
+								"ref":              NewWildcards("refs/heads/main"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelWrite,
+								"metadata": GitHubAccessLevelRead,
+							},
+						},
+					},
+					"terrabitz/bar": {
+						{
+							ID:     DefaultRuleID("terrabitz/bar", 0),
+							Source: "./testdata/auth_rule_definitions.yaml:22:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"job_workflow_ref": NewWildcards("terrabitz/workflows/.github/workflows/release.yaml@*"),
+								"sub":              NewWildcards("repo:terrabitz/bar:*"),
+								"environment":      NewWildcards("prod"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelRead,
+								"metadata": GitHubAccessLevelRead,
+								"issues":   GitHubAccessLevelWrite,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "Parses time-bounded and scheduled rules",
+			args: args{
+				file: "./testdata/auth_rule_time_bounds.yaml",
+			},
+			want: FileRuleRepository{
+				RepoRules: map[string][]AuthorizationRule{
+					"terrabitz/foo": {
+						{
+							ID:     DefaultRuleID("terrabitz/foo", 0),
+							Source: "./testdata/auth_rule_time_bounds.yaml:2:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"sub": NewWildcards("repo:terrabitz/*"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelWrite,
+							},
+							NotBefore: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+							NotAfter:  time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC),
+						},
+						{
+							ID:     DefaultRuleID("terrabitz/foo", 1),
+							Source: "./testdata/auth_rule_time_bounds.yaml:8:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"sub": NewWildcards("repo:terrabitz/*"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelWrite,
+							},
+							Schedule: []ScheduleWindow{
+								{
+									Location: mustLoadLocation("Europe/Berlin"),
+									Days:     []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+									Start:    8 * time.Hour,
+									End:      18 * time.Hour,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "Parses rule IDs, descriptions and owners",
+			args: args{
+				file: "./testdata/auth_rule_ids.yaml",
+			},
+			want: FileRuleRepository{
+				RepoRules: map[string][]AuthorizationRule{
+					"terrabitz/foo": {
+						{
+							ID:          "foo-release",
+							Description: "Lets the release workflow push tags",
+							Owner:       "release-team",
+							Source:      "./testdata/auth_rule_ids.yaml:2:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"job_workflow_ref": NewWildcards("terrabitz/workflows/.github/workflows/release.yaml@*"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelWrite,
+							},
+						},
+						{
+							ID:     DefaultRuleID("terrabitz/foo", 1),
+							Source: "./testdata/auth_rule_ids.yaml:9:5",
+							Claims: map[GitHubClaimName][]Wildcard{
+								"sub": NewWildcards("repo:terrabitz/foo:*"),
+							},
+							Permissions: PermissionSet{
+								"contents": GitHubAccessLevelRead,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "Parses a test file with sensitive rules",
+			args: args{
+				file: "./testdata/auth_rule_sensitive.yaml",
+			},
+			want: FileRuleRepository{
+				RepoRules: map[string][]AuthorizationRule{
+					"terrabitz/foo": {
+						{
+							ID:        "foo-break-glass",
+							Source:    "./testdata/auth_rule_sensitive.yaml:2:5",
+							Sensitive: true,
+							Claims: map[GitHubClaimName][]Wildcard{
+								"actor": NewWildcards("octocat"),
+							},
+							Permissions: PermissionSet{
+								"administration": GitHubAccessLevelWrite,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "Returns error for an invalid pattern",
+			args: args{
+				file: "./testdata/auth_rule_invalid_pattern.yaml",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Returns error for a condition with a type error",
+			args: args{
+				file: "./testdata/auth_rule_invalid_condition.yaml",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Returns error for an unknown permission",
+			args: args{
+				file: "./testdata/auth_rule_unknown_permission.yaml",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Returns error for an unsupported access level",
+			args: args{
+				file: "./testdata/auth_rule_unsupported_access_level.yaml",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -75,3 +308,355 @@ func TestNewFileRuleRepository(t *testing.T) {
 		})
 	}
 }
+
+func TestNewFileRuleRepository_errorPositions(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string
+		wantLine   int
+		wantColumn int
+	}{
+		{
+			name:       "Reports an unknown field",
+			file:       "./testdata/auth_rule_unknown_field.yaml",
+			wantLine:   4,
+			wantColumn: 5,
+		},
+		{
+			name:       "Reports a misspelled top-level key",
+			file:       "./testdata/auth_rule_misspelled_key.yaml",
+			wantLine:   6,
+			wantColumn: 1,
+		},
+		{
+			name:       "Reports an empty claim list",
+			file:       "./testdata/auth_rule_empty_claim.yaml",
+			wantLine:   4,
+			wantColumn: 20,
+		},
+		{
+			name:       "Reports an invalid access level",
+			file:       "./testdata/auth_rule_invalid_access_level.yaml",
+			wantLine:   5,
+			wantColumn: 17,
+		},
+		{
+			name:       "Reports an unknown permission",
+			file:       "./testdata/auth_rule_unknown_permission.yaml",
+			wantLine:   3,
+			wantColumn: 7,
+		},
+		{
+			name:       "Reports an unsupported access level",
+			file:       "./testdata/auth_rule_unsupported_access_level.yaml",
+			wantLine:   3,
+			wantColumn: 17,
+		},
+		{
+			name:       "Reports a cycle between claim sets",
+			file:       "./testdata/auth_rule_definition_cycle.yaml",
+			wantLine:   6,
+			wantColumn: 14,
+		},
+		{
+			name:       "Reports an undefined permission preset",
+			file:       "./testdata/auth_rule_undefined_reference.yaml",
+			wantLine:   9,
+			wantColumn: 16,
+		},
+		{
+			name:       "Reports an invalid schedule",
+			file:       "./testdata/auth_rule_invalid_schedule.yaml",
+			wantLine:   7,
+			wantColumn: 13,
+		},
+		{
+			name:       "Reports a duplicate rule ID",
+			file:       "./testdata/auth_rule_duplicate_id.yaml",
+			wantLine:   9,
+			wantColumn: 9,
+		},
+		{
+			name:       "Reports an invalid pattern",
+			file:       "./testdata/auth_rule_invalid_pattern.yaml",
+			wantLine:   5,
+			wantColumn: 12,
+		},
+		{
+			name:       "Reports a field set twice in a rule",
+			file:       "./testdata/auth_rule_duplicate_field.yaml",
+			wantLine:   6,
+			wantColumn: 5,
+		},
+		{
+			name:       "Reports a claim set twice",
+			file:       "./testdata/auth_rule_duplicate_claim.yaml",
+			wantLine:   4,
+			wantColumn: 7,
+		},
+		{
+			name:       "Reports a negated repository key",
+			file:       "./testdata/auth_rule_negated_key.yaml",
+			wantLine:   1,
+			wantColumn: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewFileRuleRepository(tt.file)
+
+			var fileErr *RulesFileError
+			if !errors.As(err, &fileErr) {
+				t.Fatalf("NewFileRuleRepository() error = %v, want *RulesFileError", err)
+			}
+
+			if fileErr.File != tt.file || fileErr.Line != tt.wantLine || fileErr.Column != tt.wantColumn {
+				t.Errorf("NewFileRuleRepository() error = %v, want position %s:%d:%d", err, tt.file, tt.wantLine, tt.wantColumn)
+			}
+		})
+	}
+}
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return location
+}
+
+func TestFileRuleRepository_ExpiredRules(t *testing.T) {
+	frr, err := NewFileRuleRepository("./testdata/auth_rule_time_bounds.yaml")
+	if err != nil {
+		t.Fatalf("NewFileRuleRepository() error = %v", err)
+	}
+
+	if got := frr.ExpiredRules(time.Date(2024, time.January, 15, 0, 0, 0, 0, time.UTC)); len(got) != 0 {
+		t.Errorf("ExpiredRules() = %v, want none", got)
+	}
+
+	got := Map(frr.ExpiredRules(time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)), func(rule AuthorizationRule) string { return rule.ID })
+	if diff := deep.Equal(got, []string{DefaultRuleID("terrabitz/foo", 0)}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestFileRuleRepository_GetRulesForRepo(t *testing.T) {
+	frr, err := NewFileRuleRepository("./testdata/auth_rule_patterns.yaml")
+	if err != nil {
+		t.Fatalf("NewFileRuleRepository() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		repo        string
+		wantRuleIDs []string
+	}{
+		{
+			name: "Prefers the exact key over patterns",
+			repo: "terrabitz/service-foo",
+			wantRuleIDs: []string{
+				DefaultRuleID("terrabitz/service-foo", 0),
+			},
+		},
+		{
+			name: "Prefers the most specific pattern",
+			repo: "terrabitz/service-bar",
+			wantRuleIDs: []string{
+				DefaultRuleID("terrabitz/service-*", 0),
+			},
+		},
+		{
+			name: "Falls back to the owner-wide default",
+			repo: "terrabitz/other",
+			wantRuleIDs: []string{
+				DefaultRuleID("terrabitz/*", 0),
+			},
+		},
+		{
+			name: "Returns no rules for other owners",
+			repo: "example/service-foo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := ParseRepository(tt.repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := frr.GetRulesForRepo(context.Background(), repo)
+			if err != nil {
+				t.Fatalf("GetRulesForRepo() error = %v", err)
+			}
+
+			gotRuleIDs := Map(rules, func(rule AuthorizationRule) string { return rule.ID })
+			if diff := deep.Equal(gotRuleIDs, tt.wantRuleIDs); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestFileRuleRepository_GetRulesForRepo_globKeys(t *testing.T) {
+	frr, err := NewFileRuleRepository("./testdata/auth_rule_glob_keys.yaml")
+	if err != nil {
+		t.Fatalf("NewFileRuleRepository() error = %v", err)
+	}
+
+	tests := []struct {
+		repo        string
+		wantRuleIDs []string
+	}{
+		{
+			repo:        "terrabitz/service-foo",
+			wantRuleIDs: []string{DefaultRuleID("terrabitz/service-???", 0)},
+		},
+		{
+			repo:        "terrabitz/app",
+			wantRuleIDs: []string{DefaultRuleID("terrabitz/[a-m]*", 0)},
+		},
+		{
+			repo: "terrabitz/service-quux",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			repo, err := ParseRepository(tt.repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := frr.GetRulesForRepo(context.Background(), repo)
+			if err != nil {
+				t.Fatalf("GetRulesForRepo() error = %v", err)
+			}
+
+			gotRuleIDs := Map(rules, func(rule AuthorizationRule) string { return rule.ID })
+			if diff := deep.Equal(gotRuleIDs, tt.wantRuleIDs); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestNewFileRuleRepository_allowedClaims(t *testing.T) {
+	file := "./testdata/auth_rule_custom_claims.yaml"
+
+	if _, err := NewFileRuleRepository(file); err == nil {
+		t.Fatal("NewFileRuleRepository() accepted a claim that isn't allowed")
+	}
+
+	got, err := LoadFileRuleRepository([]string{file}, AllowedClaims{"deployment_tier": true})
+	if err != nil {
+		t.Fatalf("LoadFileRuleRepository() error = %v", err)
+	}
+
+	want := map[string][]AuthorizationRule{
+		"terrabitz/foo": {
+			{
+				ID:     DefaultRuleID("terrabitz/foo", 0),
+				Source: "./testdata/auth_rule_custom_claims.yaml:2:5",
+				Claims: map[GitHubClaimName][]Wildcard{
+					"workflow_ref":    NewWildcards("terrabitz/foo/.github/workflows/release.yaml@refs/heads/main"),
+					"deployment_tier": NewWildcards("production"),
+				},
+				Permissions: PermissionSet{
+					"contents": GitHubAccessLevelWrite,
+				},
+			},
+		},
+	}
+	if diff := deep.Equal(got.RepoRules, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+type failingRuleRepository struct{}
+
+func (failingRuleRepository) GetRulesForRepo(context.Context, Repository) ([]AuthorizationRule, error) {
+	return nil, errors.New("source unavailable")
+}
+
+func TestMultiRuleRepository_GetRulesForRepo(t *testing.T) {
+	frr, err := NewFileRuleRepository("./testdata/auth_rule_patterns.yaml")
+	if err != nil {
+		t.Fatalf("NewFileRuleRepository() error = %v", err)
+	}
+
+	repo, err := ParseRepository("terrabitz/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mrr := MultiRuleRepository{
+		Sources: []AuthRuleRepository{frr, failingRuleRepository{}},
+	}
+
+	rules, err := mrr.GetRulesForRepo(context.Background(), repo)
+	if err == nil {
+		t.Fatalf("GetRulesForRepo() = %v, want error when a source fails", rules)
+	}
+}
+
+func TestFileRuleRepository_GetRulesForRepo_precedence(t *testing.T) {
+	frr, err := NewFileRuleRepository("./testdata/auth_rule_pattern_overlap.yaml")
+	if err != nil {
+		t.Fatalf("NewFileRuleRepository() error = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		repo         string
+		actor        string
+		wantContents GitHubAccessLevel
+		wantBlocked  bool
+	}{
+		{
+			name:         "An exact key narrows what an owner-wide key grants",
+			repo:         "terrabitz/foo",
+			wantContents: GitHubAccessLevelRead,
+		},
+		{
+			name:        "Denies of less specific keys still apply",
+			repo:        "terrabitz/foo",
+			actor:       "octocat",
+			wantBlocked: true,
+		},
+		{
+			name:         "A key with only deny rules doesn't replace grants",
+			repo:         "terrabitz/bar",
+			wantContents: GitHubAccessLevelWrite,
+		},
+		{
+			name:         "A key with only deny rules still denies",
+			repo:         "terrabitz/bar",
+			actor:        "mallory",
+			wantContents: GitHubAccessLevelRead,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := ParseRepository(tt.repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := frr.GetRulesForRepo(context.Background(), repo)
+			if err != nil {
+				t.Fatalf("GetRulesForRepo() error = %v", err)
+			}
+
+			claims := GitHubClaims{Sub: "repo:" + tt.repo, Actor: tt.actor}
+			decision := claims.EvaluateRules(repo, rules, time.Now)
+
+			if blocked := decision.BlockedBy != nil; blocked != tt.wantBlocked {
+				t.Fatalf("blocked = %v, want %v", blocked, tt.wantBlocked)
+			}
+			if got := decision.Permissions["contents"]; !tt.wantBlocked && got != tt.wantContents {
+				t.Errorf("contents = %v, want %v", got, tt.wantContents)
+			}
+		})
+	}
+}
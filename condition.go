@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// conditionEnv declares the variables available to rule conditions: the
+// caller's claims, and the repository a token is being requested for, with
+// its name, owner, full_name and default_branch.
+var conditionEnv = func() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("repo", cel.MapType(cel.StringType, cel.StringType)),
+	)
+	if err != nil {
+		panic(fmt.Sprintf("couldn't create condition environment: %v", err))
+	}
+
+	return env
+}()
+
+// Condition is a CEL expression that must evaluate to true for a rule to
+// match, e.g. `claims.ref_type == "tag" && claims.environment == "prod"`.
+type Condition struct {
+	Expression string
+	// UsesDefaultBranch is set if the expression may read
+	// repo.default_branch, which has to be looked up before it's evaluated.
+	UsesDefaultBranch bool
+
+	program cel.Program
+	// claims holds the claims the expression reads, unless allClaims is set
+	// because it may read any of them.
+	claims    map[string]bool
+	allClaims bool
+}
+
+// NewCondition compiles and type-checks an expression. It must evaluate to a
+// bool.
+func NewCondition(expression string) (*Condition, error) {
+	ast, issues := conditionEnv.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid condition: %w", issues.Err())
+	}
+
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("condition must evaluate to a bool, not %v", ast.OutputType())
+	}
+
+	program, err := conditionEnv.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't build condition: %w", err)
+	}
+
+	repoFields := map[string]bool{}
+	allRepoFields := fieldsRead(ast.Expr(), "repo", repoFields)
+
+	claims := map[string]bool{}
+	allClaims := fieldsRead(ast.Expr(), "claims", claims)
+
+	return &Condition{
+		Expression:        expression,
+		UsesDefaultBranch: allRepoFields || repoFields["default_branch"],
+		program:           program,
+		claims:            claims,
+		allClaims:         allClaims,
+	}, nil
+}
+
+// ReadsClaim reports whether the expression may read a claim.
+func (condition *Condition) ReadsClaim(claim GitHubClaimName) bool {
+	return condition.allClaims || condition.claims[string(claim)]
+}
+
+func (condition *Condition) Evaluate(claims GitHubClaims, repo Repository) (bool, error) {
+	out, _, err := condition.program.Eval(map[string]any{
+		"claims": claims.ToMap(),
+		"repo": map[string]string{
+			"name":           repo.Name,
+			"owner":          repo.Owner,
+			"full_name":      repo.FullName,
+			"default_branch": repo.DefaultBranch,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("couldn't evaluate condition '%s': %w", condition.Expression, err)
+	}
+
+	matches, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("condition '%s' didn't evaluate to a bool", condition.Expression)
+	}
+
+	return matches, nil
+}
+
+// fieldsRead collects the fields of a map variable that an expression reads
+// by name. Any other use of the variable, e.g. indexing it with a computed key,
+// counts as reading every field, which is reported by returning true.
+func fieldsRead(expr *exprpb.Expr, variable string, fields map[string]bool) bool {
+	if expr == nil {
+		return false
+	}
+
+	isVariable := func(expr *exprpb.Expr) bool {
+		return expr.GetIdentExpr().GetName() == variable
+	}
+	visit := func(expr *exprpb.Expr) bool {
+		return fieldsRead(expr, variable, fields)
+	}
+
+	switch kind := expr.ExprKind.(type) {
+	case *exprpb.Expr_IdentExpr:
+		return isVariable(expr)
+	case *exprpb.Expr_SelectExpr:
+		sel := kind.SelectExpr
+		if isVariable(sel.GetOperand()) {
+			fields[sel.GetField()] = true
+			return false
+		}
+
+		return visit(sel.GetOperand())
+	case *exprpb.Expr_CallExpr:
+		call := kind.CallExpr
+		if args := call.GetArgs(); call.GetFunction() == "_[_]" && len(args) == 2 && isVariable(args[0]) {
+			if key, ok := args[1].GetConstExpr().GetConstantKind().(*exprpb.Constant_StringValue); ok {
+				fields[key.StringValue] = true
+				return false
+			}
+		}
+
+		// Every argument has to be visited to collect all of their fields.
+		all := visit(call.GetTarget())
+		for _, arg := range call.GetArgs() {
+			all = visit(arg) || all
+		}
+
+		return all
+	case *exprpb.Expr_ListExpr:
+		all := false
+		for _, element := range kind.ListExpr.GetElements() {
+			all = visit(element) || all
+		}
+
+		return all
+	case *exprpb.Expr_StructExpr:
+		all := false
+		for _, entry := range kind.StructExpr.GetEntries() {
+			all = visit(entry.GetMapKey()) || all
+			all = visit(entry.GetValue()) || all
+		}
+
+		return all
+	case *exprpb.Expr_ComprehensionExpr:
+		comp := kind.ComprehensionExpr
+		all := false
+		for _, part := range []*exprpb.Expr{comp.GetIterRange(), comp.GetAccuInit(), comp.GetLoopCondition(), comp.GetLoopStep(), comp.GetResult()} {
+			all = visit(part) || all
+		}
+
+		return all
+	}
+
+	return false
+}
@@ -0,0 +1,142 @@
+package main
+
+import "testing"
+
+func TestNewCondition(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		wantErr    bool
+	}{
+		{
+			name:       "Compiles a boolean expression",
+			expression: `claims.ref == "refs/heads/main" || (claims.ref_type == "tag" && claims.environment == "prod")`,
+		},
+		{
+			name:       "Returns error for a syntax error",
+			expression: `claims.ref ==`,
+			wantErr:    true,
+		},
+		{
+			name:       "Returns error for a type error",
+			expression: `claims.ref == 1`,
+			wantErr:    true,
+		},
+		{
+			name:       "Returns error for an undeclared variable",
+			expression: `request.ref == "main"`,
+			wantErr:    true,
+		},
+		{
+			name:       "Returns error if the expression isn't a bool",
+			expression: `claims.ref`,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCondition(tt.expression)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewCondition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCondition_Evaluate(t *testing.T) {
+	repo := Repository{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo", DefaultBranch: "main"}
+
+	tests := []struct {
+		name       string
+		expression string
+		claims     GitHubClaims
+		want       bool
+	}{
+		{
+			name:       "Matches the default branch",
+			expression: `claims.ref == "refs/heads/main" || (claims.ref_type == "tag" && claims.environment == "prod")`,
+			claims:     GitHubClaims{Ref: "refs/heads/main", RefType: "branch"},
+			want:       true,
+		},
+		{
+			name:       "Matches a tag in prod",
+			expression: `claims.ref == "refs/heads/main" || (claims.ref_type == "tag" && claims.environment == "prod")`,
+			claims:     GitHubClaims{Ref: "refs/tags/v1", RefType: "tag", Environment: "prod"},
+			want:       true,
+		},
+		{
+			name:       "Doesn't match a tag outside of prod",
+			expression: `claims.ref == "refs/heads/main" || (claims.ref_type == "tag" && claims.environment == "prod")`,
+			claims:     GitHubClaims{Ref: "refs/tags/v1", RefType: "tag", Environment: "dev"},
+			want:       false,
+		},
+		{
+			name:       "Excludes an event",
+			expression: `claims.event_name != "pull_request_target"`,
+			claims:     GitHubClaims{EventName: "pull_request_target"},
+			want:       false,
+		},
+		{
+			name:       "Matches the target repository's default branch",
+			expression: `claims.ref == "refs/heads/" + repo.default_branch`,
+			claims:     GitHubClaims{Ref: "refs/heads/main"},
+			want:       true,
+		},
+		{
+			name:       "Doesn't match another branch than the default branch",
+			expression: `claims.ref == "refs/heads/" + repo.default_branch`,
+			claims:     GitHubClaims{Ref: "refs/heads/feature"},
+			want:       false,
+		},
+		{
+			name:       "Compares against the target repository",
+			expression: `claims.repository == repo.full_name`,
+			claims:     GitHubClaims{Repository: "terrabitz/foo"},
+			want:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition, err := NewCondition(tt.expression)
+			if err != nil {
+				t.Fatalf("NewCondition() error = %v", err)
+			}
+
+			got, err := condition.Evaluate(tt.claims, repo)
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Evaluate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCondition_UsesDefaultBranch(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{expression: `claims.ref == "refs/heads/" + repo.default_branch`, want: true},
+		{expression: `claims.ref == "refs/heads/" + repo["default_branch"]`, want: true},
+		{expression: `repo[claims.environment] == "main"`, want: true},
+		{expression: `"default_branch" in repo`, want: true},
+		{expression: `[repo.name, repo.default_branch].exists(v, v == "main")`, want: true},
+		{expression: `repo.name == "foo" && claims.ref_type == "tag"`, want: false},
+		{expression: `repo["owner"] == "terrabitz"`, want: false},
+		{expression: `claims.ref == "refs/heads/main"`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			condition, err := NewCondition(tt.expression)
+			if err != nil {
+				t.Fatalf("NewCondition() error = %v", err)
+			}
+
+			if condition.UsesDefaultBranch != tt.want {
+				t.Errorf("UsesDefaultBranch = %v, want %v", condition.UsesDefaultBranch, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -32,6 +37,9 @@ type Repository struct {
 	Name     string
 	Owner    string
 	FullName string
+	// DefaultBranch is only known once it has been looked up on GitHub, as
+	// rule conditions may refer to it.
+	DefaultBranch string
 }
 
 func ParseRepository(orgAndRepo string) (Repository, error) {
@@ -47,19 +55,68 @@ func ParseRepository(orgAndRepo string) (Repository, error) {
 	}, nil
 }
 
+// Wildcard matches claim values against a pattern. Patterns come in a few
+// forms:
+//
+//   - plain patterns, where '*' matches any run of characters, '?' matches a
+//     single character and '[...]' matches a character class
+//   - "glob:" patterns, which are path-aware: '*' and '?' don't match '/',
+//     while '**' matches across it
+//   - "re:" patterns, which are full regular expressions. Like every other
+//     pattern they must match the whole value, so "re:foo" doesn't match
+//     "xfoo-bar"; use "re:.*foo.*" to match anywhere in it.
+//
+// Any of these may be prefixed with '!' to negate it.
 type Wildcard struct {
 	*regexp.Regexp
+	Pattern string
+	Negated bool
 }
 
-func NewWildcard(s string) Wildcard {
-	escaped := regexp.QuoteMeta(s)
-	expanded := strings.Replace(escaped, "\\*", ".*", -1)
-	anchored := fmt.Sprintf("^%s$", expanded)
-	re, _ := regexp.Compile(anchored)
+func ParseWildcard(s string) (Wildcard, error) {
+	pattern := s
+	negated := strings.HasPrefix(pattern, "!")
+	pattern = strings.TrimPrefix(pattern, "!")
+
+	var expr string
+	switch {
+	case strings.HasPrefix(pattern, "re:"):
+		expr = fmt.Sprintf("^(?:%s)$", strings.TrimPrefix(pattern, "re:"))
+	case strings.HasPrefix(pattern, "glob:"):
+		translated, err := globToRegexp(strings.TrimPrefix(pattern, "glob:"), true)
+		if err != nil {
+			return Wildcard{}, fmt.Errorf("invalid pattern '%s': %w", s, err)
+		}
+		expr = fmt.Sprintf("^%s$", translated)
+	default:
+		translated, err := globToRegexp(pattern, false)
+		if err != nil {
+			return Wildcard{}, fmt.Errorf("invalid pattern '%s': %w", s, err)
+		}
+		expr = fmt.Sprintf("^%s$", translated)
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return Wildcard{}, fmt.Errorf("invalid pattern '%s': %w", s, err)
+	}
 
 	return Wildcard{
-		Regexp: re,
+		Regexp:  re,
+		Pattern: s,
+		Negated: negated,
+	}, nil
+}
+
+// NewWildcard is like ParseWildcard, but panics if the pattern is invalid. It's
+// meant for patterns known to be valid ahead of time.
+func NewWildcard(s string) Wildcard {
+	wildcard, err := ParseWildcard(s)
+	if err != nil {
+		panic(err)
 	}
+
+	return wildcard
 }
 
 func NewWildcards(ss ...string) []Wildcard {
@@ -71,6 +128,72 @@ func NewWildcards(ss ...string) []Wildcard {
 	return wildcards
 }
 
+// globToRegexp translates a glob into an unanchored regular expression. If
+// pathAware is set, '*' and '?' won't match '/', and '**' is needed to match
+// across it.
+func globToRegexp(glob string, pathAware bool) (string, error) {
+	anyChar, anyRun := ".", ".*"
+	if pathAware {
+		anyChar, anyRun = "[^/]", "[^/]*"
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if pathAware && i+1 < len(glob) && glob[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString(anyRun)
+			}
+		case '?':
+			sb.WriteString(anyChar)
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == 0 {
+				// A ']' right after the '[' is part of the class
+				end = strings.IndexByte(glob[i+2:], ']') + 1
+			}
+			if end <= 0 {
+				return "", errors.New("unterminated character class")
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// Matches reports whether the value matches the pattern, taking negation into
+// account.
+func (wildcard Wildcard) Matches(s string) bool {
+	return wildcard.MatchString(s) != wildcard.Negated
+}
+
+// MatchWildcards reports whether a value is matched by a list of patterns. It
+// must match at least one of the non-negated patterns, if there are any, and
+// must not match any of the negated ones.
+func MatchWildcards(wildcards []Wildcard, s string) bool {
+	positives := Filter(wildcards, func(wildcard Wildcard) bool { return !wildcard.Negated })
+	negatives := Filter(wildcards, func(wildcard Wildcard) bool { return wildcard.Negated })
+
+	if len(positives) > 0 && !Any(positives, func(wildcard Wildcard) bool { return wildcard.Matches(s) }) {
+		return false
+	}
+
+	return All(negatives, func(wildcard Wildcard) bool { return wildcard.Matches(s) })
+}
+
 type GitHubClaims struct {
 	Jti                  string `json:"jti"`
 	Sub                  string `json:"sub"`
@@ -95,47 +218,305 @@ type GitHubClaims struct {
 	EventName            string `json:"event_name"`
 	RefType              string `json:"ref_type"`
 	JobWorkflowRef       string `json:"job_workflow_ref"`
+	JobWorkflowSha       string `json:"job_workflow_sha"`
+	WorkflowRef          string `json:"workflow_ref"`
+	WorkflowSha          string `json:"workflow_sha"`
+	Enterprise           string `json:"enterprise"`
+	EnterpriseID         string `json:"enterprise_id"`
 	Iss                  string `json:"iss"`
-}
 
-func (claims GitHubClaims) GetMatchingRules(rules []AuthorizationRule) []AuthorizationRule {
-	return Filter(rules, func(rule AuthorizationRule) bool {
-		return claims.MatchesRule(rule)
-	})
+	// Raw holds every claim in the token, including ones without a field
+	// above. Rules are matched against it, so that they can use claims GitHub
+	// adds in the future.
+	Raw map[string]any `json:"-"`
 }
 
-func (claims GitHubClaims) MatchesAnyRule(rules []AuthorizationRule) bool {
-	return Any(rules, func(rule AuthorizationRule) bool {
-		return claims.MatchesRule(rule)
-	})
+// UnmarshalJSON reads the well-known claims into their fields, and every
+// claim into Raw.
+func (claims *GitHubClaims) UnmarshalJSON(b []byte) error {
+	// plainClaims has no UnmarshalJSON method, so that decoding into it
+	// doesn't recurse.
+	type plainClaims GitHubClaims
+
+	var wellKnown plainClaims
+	if err := json.Unmarshal(b, &wellKnown); err != nil {
+		return err
+	}
+
+	// Numbers are kept as they were written, rather than converted to floats,
+	// so that large IDs compare exactly.
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	var raw map[string]any
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+
+	*claims = GitHubClaims(wellKnown)
+	claims.Raw = raw
+
+	return nil
 }
 
 func (claims GitHubClaims) MatchesRule(rule AuthorizationRule) bool {
 	return All(Keys(rule.Claims), func(field GitHubClaimName) bool {
-		claimValue := claims.GetClaimValue(field)
-		wildcards := rule.Claims[field]
-
-		return Any(wildcards, func(wildcard Wildcard) bool {
-			return wildcard.MatchString(claimValue)
-		})
+		return MatchWildcards(rule.Claims[field], claims.GetClaimValue(field))
 	})
 }
 
+// MatchesRuleForRepo is like MatchesRule, but also checks that the rule is
+// active at the given time, and its condition, if it has one, against the
+// target repository. Conditions that fail to evaluate fail closed: an allow
+// rule won't match, while a deny rule will.
+func (claims GitHubClaims) MatchesRuleForRepo(rule AuthorizationRule, repo Repository, now time.Time) bool {
+	if !rule.ActiveAt(now) || !claims.MatchesRule(rule) {
+		return false
+	}
+
+	if rule.Condition == nil {
+		return true
+	}
+
+	matches, err := rule.Condition.Evaluate(claims, repo)
+	if err != nil {
+		fmt.Printf("rule '%s': %v\n", rule.ID, err)
+		return rule.Deny
+	}
+
+	return matches
+}
+
+// RuleDecision is the outcome of evaluating a set of rules against a caller.
+type RuleDecision struct {
+	// Permissions is the most the caller may request, after deny rules have
+	// been applied.
+	Permissions PermissionSet
+	AllowRules  []AuthorizationRule
+	DenyRules   []AuthorizationRule
+	// BlockedBy is set if a deny rule blocks the caller entirely.
+	BlockedBy *AuthorizationRule
+}
+
+func (decision RuleDecision) IsAllowed() bool {
+	return decision.BlockedBy == nil && len(decision.AllowRules) > 0
+}
+
+func (claims GitHubClaims) EvaluateRules(repo Repository, rules []AuthorizationRule, clock Clock) RuleDecision {
+	now := clock()
+
+	var decision RuleDecision
+	for _, rule := range rules {
+		if !claims.MatchesRuleForRepo(rule, repo, now) {
+			continue
+		}
+
+		if rule.Deny {
+			decision.DenyRules = append(decision.DenyRules, rule)
+		} else {
+			decision.AllowRules = append(decision.AllowRules, rule)
+		}
+	}
+
+	for i, rule := range decision.DenyRules {
+		if len(rule.Permissions) == 0 {
+			decision.BlockedBy = &decision.DenyRules[i]
+			break
+		}
+	}
+
+	perms := Map(decision.AllowRules, func(rule AuthorizationRule) PermissionSet { return rule.Permissions })
+	decision.Permissions = MergePermissions(perms)
+
+	for _, rule := range decision.DenyRules {
+		decision.Permissions = StripPermissions(decision.Permissions, rule.Permissions)
+	}
+
+	return decision
+}
+
+// ToMap returns every claim keyed by its name.
+func (claims GitHubClaims) ToMap() map[string]string {
+	values := getStringValuesByJSONTag(claims)
+	for name, value := range claims.Raw {
+		values[name] = claimString(value)
+	}
+
+	return values
+}
+
+// GetClaimValue returns a claim as a string. Claims are read from Raw if the
+// claims came from a token, and otherwise from the well-known fields.
 func (claims GitHubClaims) GetClaimValue(field GitHubClaimName) string {
+	if value, ok := claims.Raw[string(field)]; ok {
+		return claimString(value)
+	}
+
 	claim, _ := getStringValueByJSONTag(claims, string(field))
 	return claim
 }
 
+// claimString formats a raw claim for matching. Claims that aren't strings,
+// numbers or bools are formatted as JSON.
+func claimString(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		b, _ := json.Marshal(value)
+		return string(b)
+	}
+}
+
+// AuthorizationRule grants permissions to callers whose claims match. A rule
+// may also have a condition, which must hold on top of its claims. A deny
+// rule instead takes permissions away: with no permissions it blocks matching
+// callers entirely, and otherwise it denies each listed permission at the
+// given access level and above. Deny rules always take precedence over allows.
+//
+// Description and Owner are free-form, to help whoever is looking at a
+// decision understand a rule and know who to contact about it.
+//
+// Rules loaded from a file record their Source as "file:line:column", so that
+// decisions can be traced back to where the rule was defined.
+//
+// A Sensitive rule's claim patterns and condition are never shown when
+// explaining a decision, only whether they matched.
+//
+// A rule can be limited in time: it only applies between NotBefore and
+// NotAfter, if they're set, and within one of its schedule windows, if it has
+// any.
 type AuthorizationRule struct {
+	ID          string
+	Description string
+	Owner       string
+	Source      string
+	Deny        bool
+	Sensitive   bool
 	Claims      map[GitHubClaimName][]Wildcard
+	Condition   *Condition
 	Permissions PermissionSet
+	NotBefore   time.Time
+	NotAfter    time.Time
+	Schedule    []ScheduleWindow
+}
+
+// ActiveAt reports whether the rule applies at a given time.
+func (rule AuthorizationRule) ActiveAt(t time.Time) bool {
+	if !rule.NotBefore.IsZero() && t.Before(rule.NotBefore) {
+		return false
+	}
+
+	if !rule.NotAfter.IsZero() && !t.Before(rule.NotAfter) {
+		return false
+	}
+
+	if len(rule.Schedule) == 0 {
+		return true
+	}
+
+	return Any(rule.Schedule, func(window ScheduleWindow) bool { return window.Contains(t) })
+}
+
+// Describe names the rule by its ID and, if it has one, its owner.
+func (rule AuthorizationRule) Describe() string {
+	if rule.Owner == "" {
+		return fmt.Sprintf("'%s'", rule.ID)
+	}
+
+	return fmt.Sprintf("'%s' (owned by %s)", rule.ID, rule.Owner)
+}
+
+// PublicDescribe is like Describe, but hides a sensitive rule's ID and owner,
+// for messages sent to callers.
+func (rule AuthorizationRule) PublicDescribe() string {
+	if rule.Sensitive {
+		return redacted
+	}
+
+	return rule.Describe()
+}
+
+// PublicRuleIDs is like RuleIDs, but hides the IDs of sensitive rules, for
+// responses sent to callers.
+func PublicRuleIDs(rules []AuthorizationRule) []string {
+	return RuleIDs(Map(rules, func(rule AuthorizationRule) AuthorizationRule {
+		if rule.Sensitive {
+			rule.ID = redacted
+		}
+
+		return rule
+	}))
+}
+
+// RuleIDs returns the IDs of a list of rules, without duplicates.
+func RuleIDs(rules []AuthorizationRule) []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		if !seen[rule.ID] {
+			seen[rule.ID] = true
+			ids = append(ids, rule.ID)
+		}
+	}
+
+	return ids
+}
+
+// IsExpired reports whether the rule will never apply again after a given
+// time.
+func (rule AuthorizationRule) IsExpired(t time.Time) bool {
+	return !rule.NotAfter.IsZero() && !t.Before(rule.NotAfter)
+}
+
+// DefaultRuleID identifies an anonymous rule by the repository it's defined
+// under and its position in that repository's list of rules.
+func DefaultRuleID(repo string, index int) string {
+	return fmt.Sprintf("%s#%d", repo, index)
 }
 
 type GitHubClaimName string
 
-func NewGitHubClaimsField(s string) (GitHubClaimName, error) {
-	_, err := getStringValueByJSONTag(GitHubClaims{}, s)
-	if err != nil {
+// wellKnownClaims lists the claims GitHub documents, which rules may always
+// match on.
+var wellKnownClaims = func() map[GitHubClaimName]bool {
+	known := map[GitHubClaimName]bool{}
+	for name := range getStringValuesByJSONTag(GitHubClaims{}) {
+		known[GitHubClaimName(name)] = true
+	}
+
+	return known
+}()
+
+var claimNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// AllowedClaims lists claims besides the well-known ones that rules may match
+// on, e.g. custom claims or ones GitHub has added since the well-known claims
+// were last updated. Any other claim is rejected, to catch typos in rules
+// files. A nil AllowedClaims only allows the well-known claims.
+type AllowedClaims map[GitHubClaimName]bool
+
+func NewAllowedClaims(names []string) (AllowedClaims, error) {
+	allowed := AllowedClaims{}
+	for _, name := range names {
+		if !claimNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid claim name '%s'; may only contain letters, digits and any of '_.:-'", name)
+		}
+
+		allowed[GitHubClaimName(name)] = true
+	}
+
+	return allowed, nil
+}
+
+func NewGitHubClaimsField(s string, allowed AllowedClaims) (GitHubClaimName, error) {
+	if !wellKnownClaims[GitHubClaimName(s)] && !allowed[GitHubClaimName(s)] {
 		return GitHubClaimName(""), fmt.Errorf("invalid GitHub claim: '%s'", s)
 	}
 
@@ -168,6 +549,55 @@ func MergePermissions(permSets []PermissionSet) PermissionSet {
 	return maxPerms
 }
 
+// StripPermissions lowers each permission in perms to below the access level
+// it's denied at, removing it if even read access is denied.
+func StripPermissions(perms PermissionSet, denied PermissionSet) PermissionSet {
+	stripped := PermissionSet{}
+
+	for permission, accessLevel := range perms {
+		deniedAccessLevel, ok := denied[permission]
+		if !ok || deniedAccessLevel.GreaterThan(accessLevel) {
+			stripped[permission] = accessLevel
+			continue
+		}
+
+		if deniedAccessLevel > GitHubAccessLevelRead {
+			stripped[permission] = deniedAccessLevel - 1
+		}
+	}
+
+	return stripped
+}
+
+// IntersectPermissions returns the permissions present in every set, each at
+// the lowest access level granted among them.
+func IntersectPermissions(permSets []PermissionSet) PermissionSet {
+	if len(permSets) == 0 {
+		return PermissionSet{}
+	}
+
+	minPerms := PermissionSet{}
+	for permission, accessLevel := range permSets[0] {
+		minPerms[permission] = accessLevel
+	}
+
+	for _, permSet := range permSets[1:] {
+		for permission, accessLevel := range minPerms {
+			otherAccessLevel, ok := permSet[permission]
+			if !ok {
+				delete(minPerms, permission)
+				continue
+			}
+
+			if accessLevel.GreaterThan(otherAccessLevel) {
+				minPerms[permission] = otherAccessLevel
+			}
+		}
+	}
+
+	return minPerms
+}
+
 // ENUM(
 //
 //	read=1
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestWildcard_MatchString(t *testing.T) {
@@ -33,7 +35,132 @@ func TestWildcard_MatchString(t *testing.T) {
 	}
 }
 
-func TestGitHubClaims_MatchesAnyRule(t *testing.T) {
+func TestParseWildcard(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		matches []string
+		misses  []string
+		wantErr bool
+	}{
+		{
+			name:    "Plain '*' matches across slashes",
+			pattern: "repo:terrabitz/*",
+			matches: []string{"repo:terrabitz/foo:ref:refs/heads/main"},
+			misses:  []string{"repo:example/foo"},
+		},
+		{
+			name:    "Plain '?' matches a single character",
+			pattern: "v?",
+			matches: []string{"v1", "v2"},
+			misses:  []string{"v10", "v"},
+		},
+		{
+			name:    "Character classes",
+			pattern: "v[0-9]",
+			matches: []string{"v1"},
+			misses:  []string{"va"},
+		},
+		{
+			name:    "Negated character classes",
+			pattern: "v[!0-9]",
+			matches: []string{"va"},
+			misses:  []string{"v1"},
+		},
+		{
+			name:    "Path-aware '*' stops at slashes",
+			pattern: "glob:refs/heads/*",
+			matches: []string{"refs/heads/main"},
+			misses:  []string{"refs/heads/feature/foo"},
+		},
+		{
+			name:    "Path-aware '**' crosses slashes",
+			pattern: "glob:refs/heads/**",
+			matches: []string{"refs/heads/main", "refs/heads/feature/foo"},
+			misses:  []string{"refs/tags/v1"},
+		},
+		{
+			name:    "Path-aware '?' doesn't match slashes",
+			pattern: "glob:a?b",
+			matches: []string{"a-b"},
+			misses:  []string{"a/b"},
+		},
+		{
+			name:    "Regular expressions",
+			pattern: "re:^refs/tags/v[0-9]+\\.[0-9]+$",
+			matches: []string{"refs/tags/v1.2"},
+			misses:  []string{"refs/tags/v1.2-rc1"},
+		},
+		{
+			name:    "Regular expressions must match the whole value",
+			pattern: "re:foo|bar",
+			matches: []string{"foo", "bar"},
+			misses:  []string{"xfoo-bar", "foobar", "barx"},
+		},
+		{
+			name:    "Negated patterns",
+			pattern: "!refs/heads/dependabot/*",
+			matches: []string{"refs/heads/main"},
+			misses:  []string{"refs/heads/dependabot/npm/foo"},
+		},
+		{
+			name:    "Returns error for an invalid regular expression",
+			pattern: "re:(",
+			wantErr: true,
+		},
+		{
+			name:    "Returns error for an unterminated character class",
+			pattern: "v[0-9",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wildcard, err := ParseWildcard(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseWildcard() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			for _, s := range tt.matches {
+				if !wildcard.Matches(s) {
+					t.Errorf("Matches(%q) = false, want true", s)
+				}
+			}
+
+			for _, s := range tt.misses {
+				if wildcard.Matches(s) {
+					t.Errorf("Matches(%q) = true, want false", s)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchWildcards(t *testing.T) {
+	wildcards := NewWildcards("refs/heads/*", "!refs/heads/dependabot/*")
+
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{s: "refs/heads/main", want: true},
+		{s: "refs/heads/dependabot/npm/foo", want: false},
+		{s: "refs/tags/v1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := MatchWildcards(wildcards, tt.s); got != tt.want {
+				t.Errorf("MatchWildcards() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if !MatchWildcards(NewWildcards("!refs/heads/dependabot/*"), "refs/heads/main") {
+		t.Error("MatchWildcards() with only negated patterns = false, want true")
+	}
+}
+
+func TestGitHubClaims_EvaluateRules_MatchesClaims(t *testing.T) {
 	testClaims := GitHubClaims{
 		Sub:            "repo:example/foo",
 		Environment:    "prod",
@@ -137,6 +264,21 @@ func TestGitHubClaims_MatchesAnyRule(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name: "Doesn't match if only a deny rule matches",
+			args: args{
+				claims: testClaims,
+				rules: []AuthorizationRule{
+					{
+						Deny: true,
+						Claims: map[GitHubClaimName][]Wildcard{
+							"sub": NewWildcards("repo:example/foo"),
+						},
+					},
+				},
+			},
+			want: false,
+		},
 		{
 			name: "Matches if at least one of multiple wildcards matches",
 			args: args{
@@ -171,9 +313,9 @@ func TestGitHubClaims_MatchesAnyRule(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := tt.args.claims.MatchesAnyRule(tt.args.rules)
+			got := tt.args.claims.EvaluateRules(Repository{}, tt.args.rules, time.Now).IsAllowed()
 			if got != tt.want {
-				t.Errorf("IsCallerAuthorized() = %v, want %v", got, tt.want)
+				t.Errorf("EvaluateRules().IsAllowed() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -262,3 +404,442 @@ func TestMergePermissions(t *testing.T) {
 		})
 	}
 }
+
+func TestIntersectPermissions(t *testing.T) {
+	type args struct {
+		permSets []PermissionSet
+	}
+	tests := []struct {
+		name string
+		args args
+		want PermissionSet
+	}{
+		{
+			name: "Returns an empty set when there are no permission sets",
+			args: args{},
+			want: PermissionSet{},
+		},
+		{
+			name: "Drops permissions that aren't in every set",
+			args: args{
+				permSets: []PermissionSet{
+					{
+						"contents": GitHubAccessLevelRead,
+						"issues":   GitHubAccessLevelRead,
+					},
+					{
+						"contents": GitHubAccessLevelRead,
+					},
+				},
+			},
+			want: PermissionSet{
+				"contents": GitHubAccessLevelRead,
+			},
+		},
+		{
+			name: "Selects the lowest overlapping permissions",
+			args: args{
+				permSets: []PermissionSet{
+					{
+						"contents": GitHubAccessLevelWrite,
+					},
+					{
+						"contents": GitHubAccessLevelRead,
+					},
+					{
+						"contents": GitHubAccessLevelAdmin,
+					},
+				},
+			},
+			want: PermissionSet{
+				"contents": GitHubAccessLevelRead,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IntersectPermissions(tt.args.permSets); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("IntersectPermissions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripPermissions(t *testing.T) {
+	perms := PermissionSet{
+		"contents":      GitHubAccessLevelWrite,
+		"issues":        GitHubAccessLevelWrite,
+		"pull_requests": GitHubAccessLevelRead,
+		"packages":      GitHubAccessLevelRead,
+	}
+
+	denied := PermissionSet{
+		"contents":      GitHubAccessLevelWrite,
+		"issues":        GitHubAccessLevelRead,
+		"pull_requests": GitHubAccessLevelWrite,
+	}
+
+	want := PermissionSet{
+		"contents":      GitHubAccessLevelRead,
+		"pull_requests": GitHubAccessLevelRead,
+		"packages":      GitHubAccessLevelRead,
+	}
+
+	if got := StripPermissions(perms, denied); !reflect.DeepEqual(got, want) {
+		t.Errorf("StripPermissions() = %v, want %v", got, want)
+	}
+}
+
+func TestGitHubClaims_EvaluateRules(t *testing.T) {
+	testClaims := GitHubClaims{
+		Sub:       "repo:example/foo:pull_request",
+		EventName: "pull_request",
+	}
+	testRepo := Repository{Owner: "example", Name: "foo", FullName: "example/foo"}
+
+	allowWrite := AuthorizationRule{
+		ID: "allow-write",
+		Claims: map[GitHubClaimName][]Wildcard{
+			"sub": NewWildcards("repo:example/*"),
+		},
+		Permissions: PermissionSet{
+			"contents": GitHubAccessLevelWrite,
+			"issues":   GitHubAccessLevelWrite,
+		},
+	}
+
+	tests := []struct {
+		name            string
+		rules           []AuthorizationRule
+		wantAllowed     bool
+		wantBlockedBy   string
+		wantPermissions PermissionSet
+	}{
+		{
+			name:        "Allows with no deny rules",
+			rules:       []AuthorizationRule{allowWrite},
+			wantAllowed: true,
+			wantPermissions: PermissionSet{
+				"contents": GitHubAccessLevelWrite,
+				"issues":   GitHubAccessLevelWrite,
+			},
+		},
+		{
+			name: "Strips permissions listed by a matching deny rule",
+			rules: []AuthorizationRule{
+				allowWrite,
+				{
+					ID:   "no-write-on-pr",
+					Deny: true,
+					Claims: map[GitHubClaimName][]Wildcard{
+						"event_name": NewWildcards("pull_request"),
+					},
+					Permissions: PermissionSet{
+						"contents": GitHubAccessLevelWrite,
+						"issues":   GitHubAccessLevelWrite,
+					},
+				},
+			},
+			wantAllowed: true,
+			wantPermissions: PermissionSet{
+				"contents": GitHubAccessLevelRead,
+				"issues":   GitHubAccessLevelRead,
+			},
+		},
+		{
+			name: "Blocks entirely with a deny rule without permissions",
+			rules: []AuthorizationRule{
+				allowWrite,
+				{
+					ID:   "compromised",
+					Deny: true,
+					Claims: map[GitHubClaimName][]Wildcard{
+						"sub": NewWildcards("repo:example/foo:*"),
+					},
+				},
+			},
+			wantBlockedBy: "compromised",
+			wantPermissions: PermissionSet{
+				"contents": GitHubAccessLevelWrite,
+				"issues":   GitHubAccessLevelWrite,
+			},
+		},
+		{
+			name: "Ignores deny rules that don't match",
+			rules: []AuthorizationRule{
+				allowWrite,
+				{
+					ID:   "push-only",
+					Deny: true,
+					Claims: map[GitHubClaimName][]Wildcard{
+						"event_name": NewWildcards("push"),
+					},
+				},
+			},
+			wantAllowed: true,
+			wantPermissions: PermissionSet{
+				"contents": GitHubAccessLevelWrite,
+				"issues":   GitHubAccessLevelWrite,
+			},
+		},
+		{
+			name: "Doesn't match rules whose condition is false",
+			rules: []AuthorizationRule{
+				{
+					ID: "not-on-pr",
+					Claims: map[GitHubClaimName][]Wildcard{
+						"sub": NewWildcards("repo:example/*"),
+					},
+					Condition: mustNewCondition(t, `claims.event_name != "pull_request"`),
+					Permissions: PermissionSet{
+						"contents": GitHubAccessLevelWrite,
+					},
+				},
+			},
+			wantPermissions: PermissionSet{},
+		},
+		{
+			name: "Doesn't allow with only deny rules",
+			rules: []AuthorizationRule{
+				{
+					ID:   "no-write-on-pr",
+					Deny: true,
+					Claims: map[GitHubClaimName][]Wildcard{
+						"event_name": NewWildcards("pull_request"),
+					},
+					Permissions: PermissionSet{
+						"contents": GitHubAccessLevelWrite,
+					},
+				},
+			},
+			wantPermissions: PermissionSet{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testClaims.EvaluateRules(testRepo, tt.rules, time.Now)
+			if got.IsAllowed() != tt.wantAllowed {
+				t.Errorf("EvaluateRules().IsAllowed() = %v, want %v", got.IsAllowed(), tt.wantAllowed)
+			}
+
+			var gotBlockedBy string
+			if got.BlockedBy != nil {
+				gotBlockedBy = got.BlockedBy.ID
+			}
+			if gotBlockedBy != tt.wantBlockedBy {
+				t.Errorf("EvaluateRules().BlockedBy = %v, want %v", gotBlockedBy, tt.wantBlockedBy)
+			}
+
+			if !reflect.DeepEqual(got.Permissions, tt.wantPermissions) {
+				t.Errorf("EvaluateRules().Permissions = %v, want %v", got.Permissions, tt.wantPermissions)
+			}
+		})
+	}
+}
+
+func mustNewCondition(t *testing.T, expression string) *Condition {
+	t.Helper()
+
+	condition, err := NewCondition(expression)
+	if err != nil {
+		t.Fatalf("NewCondition() error = %v", err)
+	}
+
+	return condition
+}
+
+func TestGitHubClaims_EvaluateRules_TimeBounds(t *testing.T) {
+	testClaims := GitHubClaims{
+		Sub: "repo:example/foo",
+	}
+	testClock := func() time.Time { return time.Date(2024, time.January, 3, 12, 0, 0, 0, time.UTC) }
+
+	newRule := func(id string, modify func(rule *AuthorizationRule)) AuthorizationRule {
+		rule := AuthorizationRule{
+			ID: id,
+			Claims: map[GitHubClaimName][]Wildcard{
+				"sub": NewWildcards("repo:example/*"),
+			},
+		}
+		modify(&rule)
+
+		return rule
+	}
+
+	tests := []struct {
+		name        string
+		rule        AuthorizationRule
+		wantMatches bool
+	}{
+		{
+			name:        "Matches a rule without time bounds",
+			rule:        newRule("unbounded", func(rule *AuthorizationRule) {}),
+			wantMatches: true,
+		},
+		{
+			name: "Matches a rule within its time bounds",
+			rule: newRule("bounded", func(rule *AuthorizationRule) {
+				rule.NotBefore = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+				rule.NotAfter = time.Date(2024, time.January, 4, 0, 0, 0, 0, time.UTC)
+			}),
+			wantMatches: true,
+		},
+		{
+			name: "Doesn't match a rule before it starts",
+			rule: newRule("not-yet", func(rule *AuthorizationRule) {
+				rule.NotBefore = time.Date(2024, time.January, 4, 0, 0, 0, 0, time.UTC)
+			}),
+		},
+		{
+			name: "Doesn't match an expired rule",
+			rule: newRule("expired", func(rule *AuthorizationRule) {
+				rule.NotAfter = time.Date(2024, time.January, 3, 12, 0, 0, 0, time.UTC)
+			}),
+		},
+		{
+			name: "Matches a rule within one of its schedule windows",
+			rule: newRule("scheduled", func(rule *AuthorizationRule) {
+				rule.Schedule = []ScheduleWindow{
+					{Location: time.UTC, Start: 0, End: 6 * time.Hour},
+					{Location: time.UTC, Days: []time.Weekday{time.Wednesday}, Start: 8 * time.Hour, End: 18 * time.Hour},
+				}
+			}),
+			wantMatches: true,
+		},
+		{
+			name: "Doesn't match a rule outside of its schedule windows",
+			rule: newRule("unscheduled", func(rule *AuthorizationRule) {
+				rule.Schedule = []ScheduleWindow{
+					{Location: time.UTC, Days: []time.Weekday{time.Saturday, time.Sunday}, Start: 0, End: 24 * time.Hour},
+				}
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testClaims.EvaluateRules(Repository{}, []AuthorizationRule{tt.rule}, testClock).AllowRules
+			if gotMatches := len(got) == 1; gotMatches != tt.wantMatches {
+				t.Errorf("EvaluateRules() = %v, want match %v", got, tt.wantMatches)
+			}
+		})
+	}
+}
+
+func TestAuthorizationRule_Describe(t *testing.T) {
+	tests := []struct {
+		name string
+		rule AuthorizationRule
+		want string
+	}{
+		{
+			name: "Describes a rule by its ID",
+			rule: AuthorizationRule{ID: "release"},
+			want: "'release'",
+		},
+		{
+			name: "Includes the owner of a rule",
+			rule: AuthorizationRule{ID: "release", Owner: "release-team"},
+			want: "'release' (owned by release-team)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Describe(); got != tt.want {
+				t.Errorf("Describe() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitHubClaims_UnmarshalJSON(t *testing.T) {
+	token := `{
+		"sub": "repo:terrabitz/foo:ref:refs/heads/main",
+		"workflow_sha": "0123abcd",
+		"deployment_tier": "production",
+		"build_number": 12345678901234567890,
+		"trusted": true,
+		"teams": ["release", "docs"]
+	}`
+
+	var claims GitHubClaims
+	if err := json.Unmarshal([]byte(token), &claims); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	if claims.Sub != "repo:terrabitz/foo:ref:refs/heads/main" || claims.WorkflowSha != "0123abcd" {
+		t.Errorf("well-known claims weren't read into their fields: %+v", claims)
+	}
+
+	tests := []struct {
+		claim GitHubClaimName
+		want  string
+	}{
+		{claim: "sub", want: "repo:terrabitz/foo:ref:refs/heads/main"},
+		{claim: "deployment_tier", want: "production"},
+		{claim: "build_number", want: "12345678901234567890"},
+		{claim: "trusted", want: "true"},
+		{claim: "teams", want: `["release","docs"]`},
+		{claim: "environment", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.claim), func(t *testing.T) {
+			if got := claims.GetClaimValue(tt.claim); got != tt.want {
+				t.Errorf("GetClaimValue() = %v, want %v", got, tt.want)
+			}
+
+			if got := claims.ToMap()[string(tt.claim)]; got != tt.want {
+				t.Errorf("ToMap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewGitHubClaimsField(t *testing.T) {
+	allowed := AllowedClaims{"deployment_tier": true}
+
+	tests := []struct {
+		name    string
+		claim   string
+		allowed AllowedClaims
+		wantErr bool
+	}{
+		{
+			name:  "Accepts a well-known claim",
+			claim: "job_workflow_sha",
+		},
+		{
+			name:    "Accepts an allowed claim",
+			claim:   "deployment_tier",
+			allowed: allowed,
+		},
+		{
+			name:    "Returns error for a claim that isn't allowed",
+			claim:   "deployment_tier",
+			wantErr: true,
+		},
+		{
+			name:    "Returns error for an unknown claim",
+			claim:   "enviroment",
+			allowed: allowed,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewGitHubClaimsField(tt.claim, tt.allowed)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewGitHubClaimsField() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewAllowedClaims(t *testing.T) {
+	if _, err := NewAllowedClaims([]string{"deployment_tier", "custom:team"}); err != nil {
+		t.Errorf("NewAllowedClaims() error = %v", err)
+	}
+
+	if _, err := NewAllowedClaims([]string{"deployment tier"}); err == nil {
+		t.Error("NewAllowedClaims() accepted an invalid claim name")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultBranchCache remembers the default branch of each repository, so that
+// conditions referring to it don't cost an API call for every token.
+type DefaultBranchCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]defaultBranchCacheEntry
+}
+
+type defaultBranchCacheEntry struct {
+	branch    string
+	expiresAt time.Time
+}
+
+func NewDefaultBranchCache(ttl time.Duration) *DefaultBranchCache {
+	return &DefaultBranchCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]defaultBranchCacheEntry{},
+	}
+}
+
+// Get returns the cached default branch of a repository, if there is an
+// unexpired entry for it.
+func (c *DefaultBranchCache) Get(repo Repository) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[repo.FullName]
+	if ok && !c.now().Before(entry.expiresAt) {
+		delete(c.entries, repo.FullName)
+		return "", false
+	}
+
+	return entry.branch, ok
+}
+
+func (c *DefaultBranchCache) Set(repo Repository, branch string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[repo.FullName] = defaultBranchCacheEntry{
+		branch:    branch,
+		expiresAt: c.now().Add(c.ttl),
+	}
+}
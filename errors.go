@@ -10,6 +10,8 @@ type Error struct {
 	ExternalMessage string
 	HTTPStatusCode  int
 	Wrapped         error
+	// RuleIDs lists the rules responsible for the error, if any.
+	RuleIDs []string
 }
 
 func (err *Error) Unwrap() error {
@@ -30,6 +32,7 @@ func (err *Error) New(options ...ErrOption) *Error {
 		ExternalMessage: err.ExternalMessage,
 		HTTPStatusCode:  err.HTTPStatusCode,
 		Wrapped:         err.Wrapped,
+		RuleIDs:         err.RuleIDs,
 	}
 
 	for _, option := range options {
@@ -53,6 +56,12 @@ func WithExternalMessage(msg string) ErrOption {
 	}
 }
 
+func WithRuleIDs(ids ...string) ErrOption {
+	return func(e *Error) {
+		e.RuleIDs = ids
+	}
+}
+
 var (
 	ErrInvalidToken Error = Error{
 		InternalMessage: "invalid OIDC token",
@@ -71,4 +80,64 @@ var (
 		ExternalMessage: "invalid permissions",
 		HTTPStatusCode:  http.StatusUnauthorized,
 	}
+
+	ErrUntrustedOwner Error = Error{
+		InternalMessage: "caller's owner isn't trusted by the target owner",
+		ExternalMessage: "caller's owner isn't trusted to request tokens for the target owner",
+		HTTPStatusCode:  http.StatusForbidden,
+	}
+
+	ErrNotAuthorized Error = Error{
+		InternalMessage: "no rule authorizes caller",
+		ExternalMessage: "caller is not authorized to generate a token for this repository",
+		HTTPStatusCode:  http.StatusForbidden,
+	}
+
+	ErrRequestDenied Error = Error{
+		InternalMessage: "request denied by rule",
+		ExternalMessage: "request denied",
+		HTTPStatusCode:  http.StatusForbidden,
+	}
+
+	ErrExplainDisabled Error = Error{
+		InternalMessage: "explaining decisions is disabled",
+		ExternalMessage: "explaining decisions is disabled on this dispenser",
+		HTTPStatusCode:  http.StatusNotFound,
+	}
+
+	ErrMissingInstallationToken Error = Error{
+		InternalMessage: "missing installation token",
+		ExternalMessage: "the installation token to revoke must be included",
+		HTTPStatusCode:  http.StatusBadRequest,
+	}
+
+	ErrTokenNotIssuedToCaller Error = Error{
+		InternalMessage: "installation token wasn't issued to caller",
+		ExternalMessage: "the installation token wasn't issued to this workflow run",
+		HTTPStatusCode:  http.StatusForbidden,
+	}
+
+	ErrNoAppForOwner Error = Error{
+		InternalMessage: "no app configured for owner",
+		ExternalMessage: "the dispenser isn't configured to issue tokens for this owner",
+		HTTPStatusCode:  http.StatusBadRequest,
+	}
+
+	ErrRateLimited Error = Error{
+		InternalMessage: "GitHub rate limit exhausted",
+		ExternalMessage: "the dispenser has exhausted its GitHub rate limit; please try again later",
+		HTTPStatusCode:  http.StatusTooManyRequests,
+	}
+
+	ErrUnknownPermission Error = Error{
+		InternalMessage: "unknown permission",
+		ExternalMessage: "unknown permission",
+		HTTPStatusCode:  http.StatusBadRequest,
+	}
+
+	ErrUnsupportedAccessLevel Error = Error{
+		InternalMessage: "unsupported access level",
+		ExternalMessage: "unsupported access level",
+		HTTPStatusCode:  http.StatusBadRequest,
+	}
 )
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// redacted replaces values that the operator has marked as sensitive.
+const redacted = "[redacted]"
+
+// ExplainRequest asks why a caller would or wouldn't get a token for a
+// repository.
+type ExplainRequest struct {
+	Repo      string `json:"repo"`
+	OIDCToken string `json:"token"`
+}
+
+// ExplainResponse describes how the rules for a repository apply to a caller.
+type ExplainResponse struct {
+	Repository  string            `json:"repository"`
+	Allowed     bool              `json:"allowed"`
+	Permissions PermissionSet     `json:"permissions,omitempty"`
+	BlockedBy   string            `json:"blocked_by,omitempty"`
+	Rules       []RuleExplanation `json:"rules"`
+}
+
+// RuleExplanation describes how a single rule applies to a caller.
+type RuleExplanation struct {
+	ID          string                `json:"id"`
+	Description string                `json:"description,omitempty"`
+	Owner       string                `json:"owner,omitempty"`
+	Source      string                `json:"source,omitempty"`
+	Deny        bool                  `json:"deny,omitempty"`
+	Matched     bool                  `json:"matched"`
+	Active      bool                  `json:"active"`
+	Claims      []ClaimExplanation    `json:"claims,omitempty"`
+	Condition   *ConditionExplanation `json:"condition,omitempty"`
+	Permissions PermissionSet         `json:"permissions,omitempty"`
+}
+
+// ClaimExplanation compares one of a rule's claims to the caller's value.
+type ClaimExplanation struct {
+	Claim    GitHubClaimName `json:"claim"`
+	Patterns []string        `json:"patterns"`
+	Value    string          `json:"value"`
+	Matched  bool            `json:"matched"`
+}
+
+// ConditionExplanation describes how a rule's condition evaluated.
+type ConditionExplanation struct {
+	Expression string `json:"expression"`
+	Matched    bool   `json:"matched"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ExplainRule describes how a rule applies to the claims, comparing each of
+// its claims to the caller's value. It matches exactly when MatchesRuleForRepo
+// would.
+func (claims GitHubClaims) ExplainRule(rule AuthorizationRule, repo Repository, now time.Time) RuleExplanation {
+	explanation := RuleExplanation{
+		ID:          rule.ID,
+		Description: rule.Description,
+		Owner:       rule.Owner,
+		Source:      rule.Source,
+		Deny:        rule.Deny,
+		Active:      rule.ActiveAt(now),
+		Permissions: rule.Permissions,
+	}
+
+	claimNames := Keys(rule.Claims)
+	sort.Slice(claimNames, func(i, j int) bool { return claimNames[i] < claimNames[j] })
+
+	for _, claimName := range claimNames {
+		value := claims.GetClaimValue(claimName)
+		explanation.Claims = append(explanation.Claims, ClaimExplanation{
+			Claim:    claimName,
+			Patterns: Map(rule.Claims[claimName], func(wildcard Wildcard) string { return wildcard.Pattern }),
+			Value:    value,
+			Matched:  MatchWildcards(rule.Claims[claimName], value),
+		})
+	}
+
+	explanation.Matched = explanation.Active && All(explanation.Claims, func(claim ClaimExplanation) bool { return claim.Matched })
+
+	if rule.Condition != nil {
+		matches, err := rule.Condition.Evaluate(claims, repo)
+		explanation.Condition = &ConditionExplanation{
+			Expression: rule.Condition.Expression,
+			Matched:    matches,
+		}
+
+		// Like MatchesRuleForRepo, conditions that fail to evaluate fail
+		// closed, and that's what's reported as their outcome.
+		if err != nil {
+			explanation.Condition.Error = err.Error()
+			explanation.Condition.Matched = rule.Deny
+		}
+
+		explanation.Matched = explanation.Matched && explanation.Condition.Matched
+	}
+
+	return explanation
+}
+
+// Redact hides the values of sensitive claims, along with the rule's
+// condition if it reads any of them, since it may compare them to literal
+// values. For a sensitive rule, it hides everything but whether the rule and
+// each of its comparisons matched, so that the explanation stays useful.
+func (explanation *RuleExplanation) Redact(rule AuthorizationRule, sensitiveClaims map[GitHubClaimName]bool) {
+	sensitive := rule.Sensitive
+
+	for i, claim := range explanation.Claims {
+		if sensitiveClaims[claim.Claim] {
+			explanation.Claims[i].Value = redacted
+		}
+
+		if sensitive || sensitiveClaims[claim.Claim] {
+			explanation.Claims[i].Patterns = []string{redacted}
+		}
+	}
+
+	if explanation.Condition != nil && rule.Condition != nil {
+		readsSensitiveClaim := Any(Keys(sensitiveClaims), func(claim GitHubClaimName) bool {
+			return sensitiveClaims[claim] && rule.Condition.ReadsClaim(claim)
+		})
+		if sensitive || readsSensitiveClaim {
+			explanation.Condition.Expression = redacted
+			if explanation.Condition.Error != "" {
+				explanation.Condition.Error = redacted
+			}
+		}
+	}
+
+	if !sensitive {
+		return
+	}
+
+	explanation.ID = redacted
+	explanation.Description = ""
+	explanation.Owner = ""
+	explanation.Source = ""
+	explanation.Permissions = nil
+}
+
+// ExplainDecision explains how the rules for a repository apply to the caller
+// of an OIDC token, as GenerateGitHubToken would evaluate them. It never mints
+// a token. Claims listed in the service's redacted claims, and everything
+// compared by sensitive rules, are redacted.
+func (srv *TokenService) ExplainDecision(ctx context.Context, req ExplainRequest) (ExplainResponse, error) {
+	if !srv.explain {
+		return ExplainResponse{}, ErrExplainDisabled.New()
+	}
+
+	idToken, err := srv.verifyIDToken(ctx, req.OIDCToken)
+	if err != nil {
+		return ExplainResponse{}, err
+	}
+
+	repo, err := ParseRepository(req.Repo)
+	if err != nil {
+		return ExplainResponse{}, fmt.Errorf("invalid repository: %w", err)
+	}
+
+	var claims GitHubClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return ExplainResponse{}, fmt.Errorf("could not extract GitHub custom claims: %w", err)
+	}
+
+	// Rules describe who may access a repository, so they're only explained
+	// to callers that could ask for a token for it.
+	if !srv.ownerTrust.Allows(claims, repo.Owner) {
+		return ExplainResponse{}, ErrUntrustedOwner.New(
+			WithWrappedError(fmt.Errorf("'%s' (%s) requested an explanation for '%s'", claims.RepositoryOwner, claims.RepositoryOwnerID, repo.Owner)),
+		)
+	}
+
+	rules, repo, err := srv.getRulesForRepo(ctx, repo)
+	if err != nil {
+		return ExplainResponse{}, err
+	}
+
+	now := srv.clock()
+	clock := func() time.Time { return now }
+	decision := claims.EvaluateRules(repo, rules, clock)
+
+	res := ExplainResponse{
+		Repository:  repo.FullName,
+		Allowed:     decision.IsAllowed(),
+		Permissions: decision.Permissions,
+		Rules:       []RuleExplanation{},
+	}
+
+	if decision.BlockedBy != nil {
+		res.BlockedBy = decision.BlockedBy.ID
+		if decision.BlockedBy.Sensitive {
+			res.BlockedBy = redacted
+		}
+
+		res.Permissions = nil
+	}
+
+	for _, rule := range rules {
+		explanation := claims.ExplainRule(rule, repo, now)
+		explanation.Redact(rule, srv.redactedClaims)
+		res.Rules = append(res.Rules, explanation)
+	}
+
+	fmt.Printf("Explained decision for repo %s! rules %s\n", repo.FullName, strings.Join(RuleIDs(rules), ", "))
+
+	return res, nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestGitHubClaims_ExplainRule(t *testing.T) {
+	repo := Repository{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"}
+	claims := GitHubClaims{
+		Sub: "repo:terrabitz/foo:ref:refs/heads/main",
+		Ref: "refs/heads/main",
+	}
+	now := time.Date(2024, time.January, 3, 12, 0, 0, 0, time.UTC)
+
+	mustCondition := func(expression string) *Condition {
+		condition, err := NewCondition(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return condition
+	}
+
+	tests := []struct {
+		name string
+		rule AuthorizationRule
+		want RuleExplanation
+	}{
+		{
+			name: "Explains a matching rule",
+			rule: AuthorizationRule{
+				ID:    "main",
+				Owner: "release-team",
+				Claims: map[GitHubClaimName][]Wildcard{
+					"sub": NewWildcards("repo:terrabitz/foo:*"),
+					"ref": NewWildcards("refs/heads/main", "refs/heads/release-*"),
+				},
+				Permissions: PermissionSet{"contents": GitHubAccessLevelRead},
+			},
+			want: RuleExplanation{
+				ID:      "main",
+				Owner:   "release-team",
+				Matched: true,
+				Active:  true,
+				Claims: []ClaimExplanation{
+					{Claim: "ref", Patterns: []string{"refs/heads/main", "refs/heads/release-*"}, Value: "refs/heads/main", Matched: true},
+					{Claim: "sub", Patterns: []string{"repo:terrabitz/foo:*"}, Value: "repo:terrabitz/foo:ref:refs/heads/main", Matched: true},
+				},
+				Permissions: PermissionSet{"contents": GitHubAccessLevelRead},
+			},
+		},
+		{
+			name: "Explains which claims didn't match",
+			rule: AuthorizationRule{
+				ID: "tags",
+				Claims: map[GitHubClaimName][]Wildcard{
+					"sub":      NewWildcards("repo:terrabitz/foo:*"),
+					"ref_type": NewWildcards("tag"),
+				},
+			},
+			want: RuleExplanation{
+				ID:     "tags",
+				Active: true,
+				Claims: []ClaimExplanation{
+					{Claim: "ref_type", Patterns: []string{"tag"}, Value: "", Matched: false},
+					{Claim: "sub", Patterns: []string{"repo:terrabitz/foo:*"}, Value: "repo:terrabitz/foo:ref:refs/heads/main", Matched: true},
+				},
+			},
+		},
+		{
+			name: "Explains an inactive rule",
+			rule: AuthorizationRule{
+				ID:       "expired",
+				NotAfter: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+				Claims: map[GitHubClaimName][]Wildcard{
+					"sub": NewWildcards("repo:terrabitz/foo:*"),
+				},
+			},
+			want: RuleExplanation{
+				ID: "expired",
+				Claims: []ClaimExplanation{
+					{Claim: "sub", Patterns: []string{"repo:terrabitz/foo:*"}, Value: "repo:terrabitz/foo:ref:refs/heads/main", Matched: true},
+				},
+			},
+		},
+		{
+			name: "Explains a rule's condition",
+			rule: AuthorizationRule{
+				ID:        "condition",
+				Condition: mustCondition(`repo.name == "bar"`),
+			},
+			want: RuleExplanation{
+				ID:     "condition",
+				Active: true,
+				Condition: &ConditionExplanation{
+					Expression: `repo.name == "bar"`,
+				},
+			},
+		},
+		{
+			name: "Matches a deny rule whose condition fails to evaluate",
+			rule: AuthorizationRule{
+				ID:        "deny",
+				Deny:      true,
+				Condition: mustCondition(`claims.environment.startsWith(string(1 / 0))`),
+			},
+			want: RuleExplanation{
+				ID:      "deny",
+				Deny:    true,
+				Active:  true,
+				Matched: true,
+				Condition: &ConditionExplanation{
+					Expression: `claims.environment.startsWith(string(1 / 0))`,
+					Matched:    true,
+					Error:      "couldn't evaluate condition 'claims.environment.startsWith(string(1 / 0))': division by zero",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := claims.ExplainRule(tt.rule, repo, now)
+			if got.Matched != claims.MatchesRuleForRepo(tt.rule, repo, now) {
+				t.Errorf("ExplainRule() matched = %v, but MatchesRuleForRepo() disagrees", got.Matched)
+			}
+
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestRuleExplanation_Redact(t *testing.T) {
+	condition, err := NewCondition(`claims.ref == "refs/heads/main"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newExplanation := func() RuleExplanation {
+		return RuleExplanation{
+			ID:          "main",
+			Description: "Lets octocat release",
+			Owner:       "release-team",
+			Source:      "rules.yaml:2:5",
+			Matched:     true,
+			Claims: []ClaimExplanation{
+				{Claim: "actor", Patterns: []string{"octocat"}, Value: "octocat", Matched: true},
+				{Claim: "sub", Patterns: []string{"repo:terrabitz/foo:*"}, Value: "repo:terrabitz/foo:ref:refs/heads/main", Matched: true},
+			},
+			Condition: &ConditionExplanation{
+				Expression: `claims.ref == "refs/heads/main"`,
+				Matched:    true,
+			},
+			Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		sensitive       bool
+		sensitiveClaims map[GitHubClaimName]bool
+		want            RuleExplanation
+	}{
+		{
+			name: "Keeps everything without anything sensitive",
+			want: newExplanation(),
+		},
+		{
+			name:            "Redacts sensitive claims",
+			sensitiveClaims: map[GitHubClaimName]bool{"actor": true},
+			want: RuleExplanation{
+				ID:          "main",
+				Description: "Lets octocat release",
+				Owner:       "release-team",
+				Source:      "rules.yaml:2:5",
+				Matched:     true,
+				Claims: []ClaimExplanation{
+					{Claim: "actor", Patterns: []string{redacted}, Value: redacted, Matched: true},
+					{Claim: "sub", Patterns: []string{"repo:terrabitz/foo:*"}, Value: "repo:terrabitz/foo:ref:refs/heads/main", Matched: true},
+				},
+				Condition: &ConditionExplanation{
+					Expression: `claims.ref == "refs/heads/main"`,
+					Matched:    true,
+				},
+				Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+			},
+		},
+		{
+			name:            "Redacts a condition that reads a sensitive claim",
+			sensitiveClaims: map[GitHubClaimName]bool{"ref": true},
+			want: RuleExplanation{
+				ID:          "main",
+				Description: "Lets octocat release",
+				Owner:       "release-team",
+				Source:      "rules.yaml:2:5",
+				Matched:     true,
+				Claims: []ClaimExplanation{
+					{Claim: "actor", Patterns: []string{"octocat"}, Value: "octocat", Matched: true},
+					{Claim: "sub", Patterns: []string{"repo:terrabitz/foo:*"}, Value: "repo:terrabitz/foo:ref:refs/heads/main", Matched: true},
+				},
+				Condition: &ConditionExplanation{
+					Expression: redacted,
+					Matched:    true,
+				},
+				Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+			},
+		},
+		{
+			name:      "Redacts everything but the outcomes of a sensitive rule",
+			sensitive: true,
+			want: RuleExplanation{
+				ID:      redacted,
+				Matched: true,
+				Claims: []ClaimExplanation{
+					{Claim: "actor", Patterns: []string{redacted}, Value: "octocat", Matched: true},
+					{Claim: "sub", Patterns: []string{redacted}, Value: "repo:terrabitz/foo:ref:refs/heads/main", Matched: true},
+				},
+				Condition: &ConditionExplanation{
+					Expression: redacted,
+					Matched:    true,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newExplanation()
+			got.Redact(AuthorizationRule{Sensitive: tt.sensitive, Condition: condition}, tt.sensitiveClaims)
+
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestTokenService_ExplainDecision(t *testing.T) {
+	authRules := FileRuleRepository{
+		RepoRules: map[string][]AuthorizationRule{
+			"terrabitz/foo": {
+				{
+					ID: "release",
+					Claims: map[GitHubClaimName][]Wildcard{
+						"actor": NewWildcards("octocat"),
+					},
+					Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+				},
+			},
+			"terrabitz/bar": {
+				{
+					ID: "release",
+					Claims: map[GitHubClaimName][]Wildcard{
+						"actor": NewWildcards("octocat"),
+					},
+					Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+				},
+				{
+					ID:        "freeze",
+					Sensitive: true,
+					Deny:      true,
+					Claims: map[GitHubClaimName][]Wildcard{
+						"repository_owner": NewWildcards("terrabitz"),
+					},
+				},
+			},
+		},
+	}
+
+	callerClaims := jwt.MapClaims{"repository_owner": "terrabitz", "actor": "octocat"}
+
+	tests := []struct {
+		name    string
+		disable bool
+		claims  jwt.MapClaims
+		repo    string
+		want    ExplainResponse
+		wantErr *Error
+	}{
+		{
+			name:    "Returns error if explaining is disabled",
+			disable: true,
+			claims:  callerClaims,
+			repo:    "terrabitz/foo",
+			wantErr: &ErrExplainDisabled,
+		},
+		{
+			name:    "Returns error for an untrusted owner",
+			claims:  jwt.MapClaims{"repository_owner": "example", "actor": "octocat"},
+			repo:    "terrabitz/foo",
+			wantErr: &ErrUntrustedOwner,
+		},
+		{
+			name:   "Explains an allowed request, redacting sensitive claims",
+			claims: callerClaims,
+			repo:   "terrabitz/foo",
+			want: ExplainResponse{
+				Repository:  "terrabitz/foo",
+				Allowed:     true,
+				Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+				Rules: []RuleExplanation{
+					{
+						ID:      "release",
+						Active:  true,
+						Matched: true,
+						Claims: []ClaimExplanation{
+							{Claim: "actor", Patterns: []string{redacted}, Value: redacted, Matched: true},
+						},
+						Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+					},
+				},
+			},
+		},
+		{
+			name:   "Redacts a sensitive rule that blocks the request",
+			claims: callerClaims,
+			repo:   "terrabitz/bar",
+			want: ExplainResponse{
+				Repository: "terrabitz/bar",
+				BlockedBy:  redacted,
+				Rules: []RuleExplanation{
+					{
+						ID:      "release",
+						Active:  true,
+						Matched: true,
+						Claims: []ClaimExplanation{
+							{Claim: "actor", Patterns: []string{redacted}, Value: redacted, Matched: true},
+						},
+						Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+					},
+					{
+						ID:      redacted,
+						Deny:    true,
+						Active:  true,
+						Matched: true,
+						Claims: []ClaimExplanation{
+							{Claim: "repository_owner", Patterns: []string{redacted}, Value: "terrabitz", Matched: true},
+						},
+					},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, sign := newTestTokenService(t, http.NotFoundHandler())
+			srv.authRules = authRules
+			srv.explain = !tt.disable
+			srv.redactedClaims = map[GitHubClaimName]bool{"actor": true}
+
+			got, err := srv.ExplainDecision(context.Background(), ExplainRequest{
+				Repo:      tt.repo,
+				OIDCToken: sign(tt.claims),
+			})
+			if tt.wantErr != nil {
+				var appErr *Error
+				if !errors.As(err, &appErr) || appErr.InternalMessage != tt.wantErr.InternalMessage {
+					t.Errorf("ExplainDecision() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExplainDecision() error = %v", err)
+			}
+
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
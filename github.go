@@ -1,45 +1,359 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
+	"strings"
+	"time"
 
-	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v53/github"
 )
 
 type GitHubAppClient struct {
 	*github.Client
+	appID           int64
+	installations   *InstallationCache
+	defaultBranches *DefaultBranchCache
+	readerTokens    *TokenCache
+	limiter         *InstallationLimiter
+	retry           RetryPolicy
+	rateLimits      rateLimitTracker
+	sleep           func(context.Context, time.Duration) error
 }
 
-func NewGitHubAppClient(args Args) (*GitHubAppClient, error) {
-	itr, err := ghinstallation.NewAppsTransportKeyFromFile(http.DefaultTransport, args.AppID, args.PrivateKeyFile)
+func newGitHubAppClient(client *github.Client, appID int64, args Args) *GitHubAppClient {
+	return &GitHubAppClient{
+		Client:          client,
+		appID:           appID,
+		installations:   NewInstallationCache(args.InstallationCacheTTL),
+		defaultBranches: NewDefaultBranchCache(args.InstallationCacheTTL),
+		readerTokens:    NewTokenCache(5 * time.Minute),
+		limiter:         NewInstallationLimiter(args.InstallationConcurrency),
+		retry: RetryPolicy{
+			MaxRetries: args.MaxRetries,
+			BaseDelay:  args.RetryBaseDelay,
+			MaxDelay:   args.MaxRetryDelay,
+		},
+		sleep: sleepContext,
+	}
+}
+
+func NewGitHubAppClient(args Args, app AppConfig) (*GitHubAppClient, error) {
+	signer, err := NewSigner(app)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get transport key: %w", err)
+		return nil, fmt.Errorf("couldn't create signer: %w", err)
 	}
 
+	itr := NewAppsTransport(http.DefaultTransport, app.AppID, signer)
+
 	client := github.NewClient(&http.Client{Transport: itr})
-	return &GitHubAppClient{client}, nil
+	if args.GitHubAPIURL != "" {
+		client, err = github.NewEnterpriseClient(args.GitHubAPIURL, args.GitHubAPIURL, &http.Client{Transport: itr})
+		if err != nil {
+			return nil, fmt.Errorf("invalid GitHub API URL: %w", err)
+		}
+	}
+
+	return newGitHubAppClient(client, app.AppID, args), nil
 }
 
-func (ghClient *GitHubAppClient) GetInstallationToken(ctx context.Context, repo Repository, perms PermissionSet) (string, error) {
-	install, _, err := ghClient.Apps.FindRepositoryInstallation(ctx, repo.Owner, repo.Name)
+// GetInstallationToken mints a single installation token scoped to all of the
+// given repositories. The repositories must belong to the same installation;
+// the installation is looked up through the first one.
+func (ghClient *GitHubAppClient) GetInstallationToken(ctx context.Context, repos []Repository, perms PermissionSet) (*github.InstallationToken, error) {
+	if len(repos) == 0 {
+		return nil, errors.New("at least one repository is required")
+	}
+
+	installPerms, err := ToInstallationPermissions(perms)
 	if err != nil {
-		return "", fmt.Errorf("couldn't find repo installation: %w", err)
+		return nil, fmt.Errorf("couldn't map permissions: %w", err)
 	}
 
-	installPerms := &github.InstallationPermissions{
-		Contents: perms.GetAccessLevelString("contents"),
+	installID, cached, err := ghClient.findInstallationID(ctx, repos[0])
+	if err != nil {
+		return nil, err
 	}
 
-	token, _, err := ghClient.Apps.CreateInstallationToken(ctx, install.GetID(), &github.InstallationTokenOptions{
-		Repositories: []string{repo.Name},
+	opts := &github.InstallationTokenOptions{
+		Repositories: Map(repos, func(repo Repository) string { return repo.Name }),
 		Permissions:  installPerms,
+	}
+
+	token, err := ghClient.createInstallationToken(ctx, installID, opts)
+	if cached && isStaleInstallationError(err) {
+		// The app may have been uninstalled or the repository moved since the
+		// installation was cached, so look it up again before giving up.
+		ghClient.installations.Invalidate(repos[0])
+
+		installID, _, err = ghClient.findInstallationID(ctx, repos[0])
+		if err != nil {
+			return nil, err
+		}
+
+		token, err = ghClient.createInstallationToken(ctx, installID, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create installation token: %w", err)
+	}
+
+	return token, nil
+}
+
+// RevokeInstallationToken revokes an installation token. GitHub only allows
+// a token to revoke itself, so the request is authenticated with the token
+// being revoked rather than the app's credentials.
+func (ghClient *GitHubAppClient) RevokeInstallationToken(ctx context.Context, token string) error {
+	if _, err := ghClient.tokenClient(token).Apps.RevokeInstallationToken(ctx); err != nil {
+		return fmt.Errorf("couldn't revoke installation token: %w", err)
+	}
+
+	return nil
+}
+
+// RepositoryFile is a file read from a repository's default branch.
+type RepositoryFile struct {
+	Content []byte
+	ETag    string
+	// NotModified is set when the file still matches the ETag it was requested
+	// with, in which case Content is empty.
+	NotModified bool
+	// NotFound is set when the repository has no such file.
+	NotFound bool
+}
+
+// GetRepositoryFile reads a file from the default branch of a repository. If
+// etag is set, the request is conditional and GitHub only sends the content
+// when it has changed. The file is read with a short-lived token that can only
+// read the repository's contents.
+func (ghClient *GitHubAppClient) GetRepositoryFile(ctx context.Context, repo Repository, path, etag string) (RepositoryFile, error) {
+	token, err := ghClient.readerToken(ctx, repo, PermissionSet{"contents": GitHubAccessLevelRead})
+	if err != nil {
+		return RepositoryFile{}, err
+	}
+
+	tokenClient := ghClient.tokenClient(token.GetToken())
+
+	u := fmt.Sprintf("repos/%s/%s/contents/%s", repo.Owner, repo.Name, strings.TrimPrefix(path, "/"))
+	req, err := tokenClient.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return RepositoryFile{}, err
+	}
+
+	req.Header.Set("Accept", "application/vnd.github.raw")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	var content bytes.Buffer
+	var resp *github.Response
+	err = ghClient.withRetry(ctx, func() (*github.Response, error) {
+		content.Reset()
+		resp, err = tokenClient.Do(ctx, req, &content)
+		return resp, err
+	})
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusNotModified:
+			return RepositoryFile{ETag: etag, NotModified: true}, nil
+		case http.StatusNotFound:
+			return RepositoryFile{NotFound: true}, nil
+		}
+	}
+	if err != nil {
+		return RepositoryFile{}, fmt.Errorf("couldn't read '%s' from %s: %w", path, repo.FullName, err)
+	}
+
+	return RepositoryFile{
+		Content: content.Bytes(),
+		ETag:    resp.Header.Get("ETag"),
+	}, nil
+}
+
+// GetDefaultBranch looks up the default branch of a repository, with a
+// short-lived token that can only read its metadata, which every installation
+// has access to. Branches are cached for as long as installations are.
+func (ghClient *GitHubAppClient) GetDefaultBranch(ctx context.Context, repo Repository) (string, error) {
+	if branch, ok := ghClient.defaultBranches.Get(repo); ok {
+		return branch, nil
+	}
+
+	token, err := ghClient.readerToken(ctx, repo, PermissionSet{"metadata": GitHubAccessLevelRead})
+	if err != nil {
+		return "", err
+	}
+
+	tokenClient := ghClient.tokenClient(token.GetToken())
+
+	var ghRepo *github.Repository
+	err = ghClient.withRetry(ctx, func() (resp *github.Response, err error) {
+		ghRepo, resp, err = tokenClient.Repositories.Get(ctx, repo.Owner, repo.Name)
+		return resp, err
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't look up %s: %w", repo.FullName, err)
+	}
+
+	ghClient.defaultBranches.Set(repo, ghRepo.GetDefaultBranch())
+
+	return ghRepo.GetDefaultBranch(), nil
+}
+
+// readerToken returns a cached token for a repository that only carries the
+// given read permissions.
+func (ghClient *GitHubAppClient) readerToken(ctx context.Context, repo Repository, perms PermissionSet) (*github.InstallationToken, error) {
+	repos := []Repository{repo}
+
+	return ghClient.readerTokens.GetOrCreate(ctx, TokenCacheKey(repos, perms), func(ctx context.Context) (*github.InstallationToken, error) {
+		return ghClient.GetInstallationToken(ctx, repos, perms)
+	})
+}
+
+// tokenClient returns a client that authenticates with an installation token
+// instead of the app's credentials.
+func (ghClient *GitHubAppClient) tokenClient(token string) *github.Client {
+	tokenClient := github.NewClient(&http.Client{
+		Transport: &installationTokenTransport{token: token, base: http.DefaultTransport},
+	})
+	tokenClient.BaseURL = ghClient.BaseURL
+
+	return tokenClient
+}
+
+type installationTokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *installationTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "token "+t.token)
+
+	return t.base.RoundTrip(req)
+}
+
+// findInstallationID returns the installation ID for a repository, and whether
+// it was served from the cache.
+func (ghClient *GitHubAppClient) findInstallationID(ctx context.Context, repo Repository) (int64, bool, error) {
+	if installID, ok := ghClient.installations.Get(repo); ok {
+		return installID, true, nil
+	}
+
+	var install *github.Installation
+	err := ghClient.withRetry(ctx, func() (resp *github.Response, err error) {
+		install, resp, err = ghClient.Apps.FindRepositoryInstallation(ctx, repo.Owner, repo.Name)
+		return resp, err
 	})
 	if err != nil {
-		return "", fmt.Errorf("couldn't create installation token: %w", err)
+		return 0, false, fmt.Errorf("couldn't find repo installation: %w", err)
+	}
+
+	ghClient.installations.Set(repo, install.GetID())
+
+	return install.GetID(), false, nil
+}
+
+// createInstallationToken calls GitHub to create an installation token,
+// respecting the per-installation concurrency limit and retry policy.
+func (ghClient *GitHubAppClient) createInstallationToken(ctx context.Context, installID int64, opts *github.InstallationTokenOptions) (*github.InstallationToken, error) {
+	release, err := ghClient.limiter.Acquire(ctx, installID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var token *github.InstallationToken
+	err = ghClient.withRetry(ctx, func() (resp *github.Response, err error) {
+		token, resp, err = ghClient.Apps.CreateInstallationToken(ctx, installID, opts)
+		return resp, err
+	})
+
+	return token, err
+}
+
+func (ghClient *GitHubAppClient) InstallationCacheStats() InstallationCacheStats {
+	return ghClient.installations.Stats()
+}
+
+func (ghClient *GitHubAppClient) RateLimitStats() RateLimitStats {
+	return ghClient.rateLimits.Stats()
+}
+
+// isStaleInstallationError reports whether an error from GitHub indicates that
+// an installation no longer serves the repository it was looked up for.
+func isStaleInstallationError(err error) bool {
+	var ghErr *github.ErrorResponse
+	if !errors.As(err, &ghErr) || ghErr.Response == nil {
+		return false
+	}
+
+	return ghErr.Response.StatusCode == http.StatusNotFound || ghErr.Response.StatusCode == http.StatusForbidden
+}
+
+// installationPermissionFields maps each permission name (the JSON tag used by
+// the GitHub API) to the index of its field in github.InstallationPermissions.
+var installationPermissionFields = func() map[string]int {
+	fields := map[string]int{}
+
+	st := reflect.TypeOf(github.InstallationPermissions{})
+	for i := 0; i < st.NumField(); i++ {
+		tag, ok := st.Field(i).Tag.Lookup("json")
+		if !ok {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+		fields[name] = i
+	}
+
+	return fields
+}()
+
+// ToInstallationPermissions converts a PermissionSet into the permissions
+// object sent to GitHub when creating an installation token. Every permission
+// in the set must have an equivalent field in github.InstallationPermissions.
+func ToInstallationPermissions(perms PermissionSet) (*github.InstallationPermissions, error) {
+	installPerms := &github.InstallationPermissions{}
+	val := reflect.ValueOf(installPerms).Elem()
+
+	for permission := range perms {
+		i, ok := installationPermissionFields[permission]
+		if !ok {
+			return nil, fmt.Errorf("permission '%s' has no GitHub equivalent", permission)
+		}
+
+		val.Field(i).Set(reflect.ValueOf(perms.GetAccessLevelString(permission)))
+	}
+
+	return installPerms, nil
+}
+
+// FromInstallationPermissions converts the permissions object returned by
+// GitHub back into a PermissionSet. Unset fields are omitted.
+func FromInstallationPermissions(installPerms *github.InstallationPermissions) (PermissionSet, error) {
+	perms := PermissionSet{}
+	if installPerms == nil {
+		return perms, nil
+	}
+
+	val := reflect.ValueOf(installPerms).Elem()
+	for permission, i := range installationPermissionFields {
+		field := val.Field(i)
+		if field.IsNil() {
+			continue
+		}
+
+		accessLevel, err := ParseGitHubAccessLevel(field.Elem().String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid access level for permission '%s': %w", permission, err)
+		}
+
+		perms[permission] = accessLevel
 	}
 
-	return token.GetToken(), nil
+	return perms, nil
 }
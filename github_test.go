@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/google/go-github/v53/github"
+)
+
+func TestToInstallationPermissions(t *testing.T) {
+	type args struct {
+		perms PermissionSet
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    *github.InstallationPermissions
+		wantErr bool
+	}{
+		{
+			name: "Maps an empty permission set",
+			args: args{
+				perms: PermissionSet{},
+			},
+			want: &github.InstallationPermissions{},
+		},
+		{
+			name: "Maps multiple permissions",
+			args: args{
+				perms: PermissionSet{
+					"contents":      GitHubAccessLevelRead,
+					"pull_requests": GitHubAccessLevelWrite,
+					"issues":        GitHubAccessLevelWrite,
+					"packages":      GitHubAccessLevelRead,
+					"actions":       GitHubAccessLevelRead,
+					"checks":        GitHubAccessLevelWrite,
+					"deployments":   GitHubAccessLevelWrite,
+				},
+			},
+			want: &github.InstallationPermissions{
+				Contents:     github.String("read"),
+				PullRequests: github.String("write"),
+				Issues:       github.String("write"),
+				Packages:     github.String("read"),
+				Actions:      github.String("read"),
+				Checks:       github.String("write"),
+				Deployments:  github.String("write"),
+			},
+		},
+		{
+			name: "Returns error for a permission with no GitHub equivalent",
+			args: args{
+				perms: PermissionSet{
+					"content": GitHubAccessLevelRead,
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToInstallationPermissions(tt.args.perms)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ToInstallationPermissions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestInstallationPermissions_RoundTrip(t *testing.T) {
+	st := reflect.TypeOf(github.InstallationPermissions{})
+	if len(installationPermissionFields) != st.NumField() {
+		t.Fatalf("mapped %d permissions, want %d", len(installationPermissionFields), st.NumField())
+	}
+
+	for permission := range installationPermissionFields {
+		t.Run(permission, func(t *testing.T) {
+			perms := PermissionSet{permission: GitHubAccessLevelWrite}
+
+			installPerms, err := ToInstallationPermissions(perms)
+			if err != nil {
+				t.Fatalf("ToInstallationPermissions() error = %v", err)
+			}
+
+			got, err := FromInstallationPermissions(installPerms)
+			if err != nil {
+				t.Fatalf("FromInstallationPermissions() error = %v", err)
+			}
+
+			if diff := deep.Equal(got, perms); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+// newTestGitHubAppClient returns a client that talks to a fake GitHub API
+// served by the given handler.
+func newTestGitHubAppClient(t *testing.T, handler http.Handler) *GitHubAppClient {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	ghClient := newGitHubAppClient(client, 1, Args{
+		InstallationCacheTTL:    time.Hour,
+		InstallationConcurrency: 1,
+		MaxRetries:              2,
+		RetryBaseDelay:          time.Millisecond,
+		MaxRetryDelay:           time.Minute,
+	})
+	ghClient.sleep = func(context.Context, time.Duration) error { return nil }
+
+	return ghClient
+}
+
+func TestGitHubAppClient_GetInstallationToken_RetriesStaleInstallation(t *testing.T) {
+	currentInstallID := 1
+	lookups := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/terrabitz/foo/installation", func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		fmt.Fprintf(w, `{"id": %d}`, currentInstallID)
+	})
+	mux.HandleFunc("/app/installations/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != fmt.Sprintf("/app/installations/%d/access_tokens", currentInstallID) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+			return
+		}
+
+		fmt.Fprint(w, `{"token": "ghs_test"}`)
+	})
+
+	ghClient := newTestGitHubAppClient(t, mux)
+	repos := []Repository{{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"}}
+	perms := PermissionSet{"contents": GitHubAccessLevelRead}
+
+	for i := 0; i < 2; i++ {
+		if _, err := ghClient.GetInstallationToken(context.Background(), repos, perms); err != nil {
+			t.Fatalf("GetInstallationToken() error = %v", err)
+		}
+	}
+
+	// The app gets reinstalled under a new installation ID
+	currentInstallID = 2
+
+	token, err := ghClient.GetInstallationToken(context.Background(), repos, perms)
+	if err != nil {
+		t.Fatalf("GetInstallationToken() error = %v", err)
+	}
+	if token.GetToken() != "ghs_test" {
+		t.Errorf("GetInstallationToken() = %v, want ghs_test", token)
+	}
+
+	if lookups != 2 {
+		t.Errorf("looked up installation %d times, want 2", lookups)
+	}
+
+	want := InstallationCacheStats{Hits: 2, Misses: 2}
+	if got := ghClient.InstallationCacheStats(); got != want {
+		t.Errorf("InstallationCacheStats() = %v, want %v", got, want)
+	}
+}
+
+func TestGitHubAppClient_RevokeInstallationToken(t *testing.T) {
+	var gotAuth string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/installation/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		gotAuth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	ghClient := newTestGitHubAppClient(t, mux)
+
+	if err := ghClient.RevokeInstallationToken(context.Background(), "ghs_test"); err != nil {
+		t.Fatalf("RevokeInstallationToken() error = %v", err)
+	}
+
+	if gotAuth != "token ghs_test" {
+		t.Errorf("revoked with Authorization = %v, want 'token ghs_test'", gotAuth)
+	}
+}
+
+func TestGitHubAppClient_GetDefaultBranch(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/terrabitz/foo/installation", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 1}`)
+	})
+	mux.HandleFunc("/app/installations/1/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"token": "ghs_reader", "expires_at": "2099-01-01T00:00:00Z"}`)
+	})
+	mux.HandleFunc("/repos/terrabitz/foo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token ghs_reader" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprint(w, `{"full_name": "terrabitz/foo", "default_branch": "trunk"}`)
+	})
+
+	ghClient := newTestGitHubAppClient(t, mux)
+	repo := Repository{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"}
+
+	got, err := ghClient.GetDefaultBranch(context.Background(), repo)
+	if err != nil {
+		t.Fatalf("GetDefaultBranch() error = %v", err)
+	}
+	if got != "trunk" {
+		t.Errorf("GetDefaultBranch() = %v, want trunk", got)
+	}
+}
@@ -23,6 +23,10 @@ func NewHTTPServer(srv *TokenService) *HTTPServer {
 	}
 
 	mux.Handle("/token", httpSrv.GenerateGitHubToken())
+	mux.Handle("/revoke", httpSrv.RevokeGitHubToken())
+	mux.Handle("/explain", httpSrv.ExplainDecision())
+	mux.Handle("/stats", httpSrv.Stats())
+	mux.Handle("/status", httpSrv.Status())
 
 	return httpSrv
 }
@@ -46,29 +50,112 @@ func (srv *HTTPServer) GenerateGitHubToken() http.Handler {
 
 		res, err := srv.tokenSrv.GenerateGitHubToken(r.Context(), req)
 		if err != nil {
-			res := ErrorMessage{
-				Error: "something went wrong; please open a ticket at https://github.com/terrabitz/gha-token-dispenser",
-				Code:  http.StatusInternalServerError,
-			}
-
-			var appError *Error
-			if errors.As(err, &appError) {
-				res.Error = appError.ExternalMessage
-				res.Code = appError.HTTPStatusCode
-			}
-
-			fmt.Printf("%v\n", err)
-			w.WriteHeader(res.Code)
-			_ = json.NewEncoder(w).Encode(res)
+			writeError(w, err)
 			return
 		}
 
-		fmt.Fprint(w, res.Token)
+		_ = json.NewEncoder(w).Encode(res)
 		fmt.Println("Sent install token!")
 	})
 }
 
+func (srv *HTTPServer) RevokeGitHubToken() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			return
+		}
+
+		var req RevokeTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fmt.Printf("couldn't decode request: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		defer r.Body.Close()
+
+		if err := srv.tokenSrv.RevokeGitHubToken(r.Context(), req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (srv *HTTPServer) ExplainDecision() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			return
+		}
+
+		var req ExplainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fmt.Printf("couldn't decode request: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		defer r.Body.Close()
+
+		res, err := srv.tokenSrv.ExplainDecision(r.Context(), req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+func (srv *HTTPServer) Stats() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(srv.tokenSrv.Stats())
+	})
+}
+
 type ErrorMessage struct {
-	Error string `json:"error,omitempty"`
-	Code  int    `json:"code,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Code    int      `json:"code,omitempty"`
+	RuleIDs []string `json:"rule_ids,omitempty"`
+}
+
+func (srv *HTTPServer) Status() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(srv.tokenSrv.Status())
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	res := ErrorMessage{
+		Error: "something went wrong; please open a ticket at https://github.com/terrabitz/gha-token-dispenser",
+		Code:  http.StatusInternalServerError,
+	}
+
+	var appError *Error
+	if errors.As(err, &appError) {
+		res.Error = appError.ExternalMessage
+		res.Code = appError.HTTPStatusCode
+		res.RuleIDs = appError.RuleIDs
+	}
+
+	fmt.Printf("%v\n", err)
+	w.WriteHeader(res.Code)
+	_ = json.NewEncoder(w).Encode(res)
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-github/v53/github"
+)
+
+func TestHTTPServer_RevokeGitHubToken(t *testing.T) {
+	var revokes atomic.Int64
+	var fail atomic.Bool
+
+	tokenSrv, sign := newTestTokenService(t, fakeRevokeHandler(&revokes, &fail))
+	tokenSrv.issuedTokens.Record(&github.InstallationToken{
+		Token:     github.String("ghs_issued"),
+		ExpiresAt: &github.Timestamp{Time: time.Now().Add(time.Hour)},
+	}, "terrabitz", TokenHolder{Repository: "terrabitz/foo", RunID: "1"})
+
+	handler := NewHTTPServer(tokenSrv).Handler
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{
+			name:     "Rejects a request without an installation token",
+			body:     `{"token": "` + sign(jwt.MapClaims{"repository": "terrabitz/foo", "run_id": "1"}) + `"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Rejects a revoke from another run",
+			body:     `{"token": "` + sign(jwt.MapClaims{"repository": "terrabitz/foo", "run_id": "2"}) + `", "installation_token": "ghs_issued"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "Revokes a token for the run it was issued to",
+			body:     `{"token": "` + sign(jwt.MapClaims{"repository": "terrabitz/foo", "run_id": "1"}) + `", "installation_token": "ghs_issued"}`,
+			wantCode: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/revoke", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+
+			if tt.wantCode != http.StatusNoContent {
+				var res ErrorMessage
+				if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.Code != tt.wantCode {
+					t.Errorf("got error response %+v (%v), want code %d", res, err, tt.wantCode)
+				}
+			}
+		})
+	}
+
+	if got := revokes.Load(); got != 1 {
+		t.Errorf("revoked %d tokens, want 1", got)
+	}
+}
+
+func TestHTTPServer_ExplainDecision(t *testing.T) {
+	tokenSrv, sign := newTestTokenService(t, http.NotFoundHandler())
+	handler := NewHTTPServer(tokenSrv).Handler
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{
+			name:     "Rejects a malformed request",
+			body:     `{`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Returns not found while explaining is disabled",
+			body:     `{"repo": "terrabitz/foo", "token": "` + sign(jwt.MapClaims{"repository_owner": "terrabitz"}) + `"}`,
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/explain", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestHTTPServer_GenerateGitHubToken(t *testing.T) {
+	tokenSrv, sign := newTestTokenService(t, fakeTokenHandler())
+	tokenSrv.authRules = mapRuleRepository{
+		"terrabitz/foo": {{
+			ID:          "foo-read",
+			Claims:      map[GitHubClaimName][]Wildcard{"repository_owner": NewWildcards("terrabitz")},
+			Permissions: PermissionSet{"contents": GitHubAccessLevelRead},
+		}},
+	}
+
+	handler := NewHTTPServer(tokenSrv).Handler
+	oidcToken := sign(jwt.MapClaims{"repository": "terrabitz/caller", "repository_owner": "terrabitz", "run_id": "1"})
+
+	tests := []struct {
+		name        string
+		body        string
+		wantCode    int
+		wantRes     GetTokenResponse
+		wantRuleIDs []string
+	}{
+		{
+			name:     "Sends the token along with what it grants",
+			body:     `{"token": "` + oidcToken + `", "repo": "terrabitz/foo", "permissions": {"contents": "read"}}`,
+			wantCode: http.StatusOK,
+			wantRes: GetTokenResponse{
+				Token:        "ghs_test",
+				ExpiresAt:    time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+				Permissions:  PermissionSet{"contents": GitHubAccessLevelRead},
+				Repositories: []string{"terrabitz/foo"},
+				RuleIDs:      []string{"foo-read"},
+			},
+		},
+		{
+			name:        "Reports the rules that limit the permissions",
+			body:        `{"token": "` + oidcToken + `", "repo": "terrabitz/foo", "permissions": {"contents": "write"}}`,
+			wantCode:    http.StatusUnauthorized,
+			wantRuleIDs: []string{"foo-read"},
+		},
+		{
+			name:     "Rejects an invalid OIDC token",
+			body:     `{"token": "invalid", "repo": "terrabitz/foo", "permissions": {"contents": "read"}}`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			if tt.wantCode != http.StatusOK {
+				var res ErrorMessage
+				if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.Code != tt.wantCode {
+					t.Errorf("got error response %+v (%v), want code %d", res, err, tt.wantCode)
+				}
+				if diff := deep.Equal(res.RuleIDs, tt.wantRuleIDs); diff != nil {
+					t.Errorf("RuleIDs: %v", diff)
+				}
+				return
+			}
+
+			var res GetTokenResponse
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatalf("couldn't decode response: %v", err)
+			}
+			if diff := deep.Equal(res, tt.wantRes); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InstallationCache remembers which installation ID serves a repository so
+// that FindRepositoryInstallation doesn't have to be called for every token.
+type InstallationCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]installationCacheEntry
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type installationCacheEntry struct {
+	installationID int64
+	expiresAt      time.Time
+}
+
+type InstallationCacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+func NewInstallationCache(ttl time.Duration) *InstallationCache {
+	return &InstallationCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]installationCacheEntry{},
+	}
+}
+
+// Get returns the cached installation ID for a repository, if there is an
+// unexpired entry for it.
+func (c *InstallationCache) Get(repo Repository) (int64, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[repo.FullName]
+	if ok && !c.now().Before(entry.expiresAt) {
+		delete(c.entries, repo.FullName)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return 0, false
+	}
+
+	c.hits.Add(1)
+	return entry.installationID, true
+}
+
+func (c *InstallationCache) Set(repo Repository, installationID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[repo.FullName] = installationCacheEntry{
+		installationID: installationID,
+		expiresAt:      c.now().Add(c.ttl),
+	}
+}
+
+func (c *InstallationCache) Invalidate(repo Repository) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, repo.FullName)
+}
+
+func (c *InstallationCache) Stats() InstallationCacheStats {
+	return InstallationCacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInstallationCache(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache := NewInstallationCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	repo := Repository{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"}
+
+	if _, ok := cache.Get(repo); ok {
+		t.Fatal("Get() on an empty cache returned an entry")
+	}
+
+	cache.Set(repo, 42)
+	if got, ok := cache.Get(repo); !ok || got != 42 {
+		t.Fatalf("Get() = %v, %v, want 42, true", got, ok)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := cache.Get(repo); ok {
+		t.Fatal("Get() returned an expired entry")
+	}
+
+	cache.Set(repo, 42)
+	cache.Invalidate(repo)
+	if _, ok := cache.Get(repo); ok {
+		t.Fatal("Get() returned an invalidated entry")
+	}
+
+	want := InstallationCacheStats{Hits: 1, Misses: 3}
+	if got := cache.Stats(); got != want {
+		t.Errorf("Stats() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+)
+
+// TokenHolder identifies the workflow run an installation token was issued
+// to.
+type TokenHolder struct {
+	Repository string
+	RunID      string
+}
+
+func NewTokenHolder(claims GitHubClaims) TokenHolder {
+	return TokenHolder{
+		Repository: claims.Repository,
+		RunID:      claims.RunID,
+	}
+}
+
+func (holder TokenHolder) String() string {
+	return fmt.Sprintf("%s run %s", holder.Repository, holder.RunID)
+}
+
+// IssuedTokens remembers which workflow runs each installation token was
+// issued to until it expires, so that only those runs may revoke it. A run
+// that was issued the same token several times, e.g. from the token cache
+// for each leg of a matrix, holds it once for each time.
+type IssuedTokens struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]*issuedToken
+}
+
+type issuedToken struct {
+	owner     string
+	expiresAt time.Time
+	holders   map[TokenHolder]int
+}
+
+func NewIssuedTokens() *IssuedTokens {
+	return &IssuedTokens{
+		now:    time.Now,
+		tokens: map[string]*issuedToken{},
+	}
+}
+
+// Record notes that a token for an owner's repositories was issued to a
+// holder. The same token may be issued to several holders, e.g. when it
+// comes from the token cache.
+func (t *IssuedTokens) Record(token *github.InstallationToken, owner string, holder TokenHolder) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for key, issued := range t.tokens {
+		if !now.Before(issued.expiresAt) {
+			delete(t.tokens, key)
+		}
+	}
+
+	issued, ok := t.tokens[token.GetToken()]
+	if !ok {
+		issued = &issuedToken{
+			owner:     owner,
+			expiresAt: token.GetExpiresAt().Time,
+			holders:   map[TokenHolder]int{},
+		}
+		t.tokens[token.GetToken()] = issued
+	}
+
+	issued.holders[holder]++
+}
+
+// Release gives up one of a holder's holds on a token, and returns the owner
+// of the repositories the token was issued for. It fails if the token wasn't
+// issued to the holder.
+func (t *IssuedTokens) Release(token string, holder TokenHolder) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	issued, ok := t.tokens[token]
+	if !ok || !t.now().Before(issued.expiresAt) {
+		return "", fmt.Errorf("token wasn't issued by this dispenser or has expired")
+	}
+
+	if issued.holders[holder] == 0 {
+		return "", fmt.Errorf("token wasn't issued to %s", holder)
+	}
+
+	issued.holders[holder]--
+
+	return issued.owner, nil
+}
+
+// Restore takes back a hold given up with Release, e.g. because revoking the
+// token failed.
+func (t *IssuedTokens) Restore(token string, holder TokenHolder) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if issued, ok := t.tokens[token]; ok {
+		issued.holders[holder]++
+	}
+}
+
+// Forget removes a token, e.g. because it has been revoked.
+func (t *IssuedTokens) Forget(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.tokens, token)
+}
@@ -5,9 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/go-github/v53/github"
 	"github.com/joho/godotenv"
 	cli "github.com/urfave/cli/v2"
 )
@@ -15,9 +20,29 @@ import (
 const githubTokenIssuer = "https://token.actions.githubusercontent.com"
 
 type Args struct {
-	AppID          int64
-	PrivateKeyFile string
-	RulesFile      string
+	AppID                   int64
+	PrivateKeyFile          string
+	PrivateKeyEnv           string
+	SigningCommand          string
+	AppsFile                string
+	RulesFiles              cli.StringSlice
+	RepoPolicies            bool
+	RepoPolicyPath          string
+	OrgPolicyRepo           string
+	OrgPolicyPath           string
+	TrustFile               string
+	InstallationCacheTTL    time.Duration
+	TokenCache              bool
+	TokenCacheMinTTL        time.Duration
+	GitHubAPIURL            string
+	OIDCIssuer              string
+	MaxRetries              int
+	RetryBaseDelay          time.Duration
+	MaxRetryDelay           time.Duration
+	InstallationConcurrency int
+	Explain                 bool
+	ExplainRedactClaims     cli.StringSlice
+	AllowClaims             cli.StringSlice
 }
 
 func main() {
@@ -31,20 +56,126 @@ func main() {
 			&cli.Int64Flag{
 				Name:        "app-id",
 				Destination: &args.AppID,
-				Required:    true,
 				EnvVars:     []string{"APP_ID"},
 			},
 			&cli.StringFlag{
 				Name:        "private-key-file",
 				Destination: &args.PrivateKeyFile,
-				Required:    true,
 				EnvVars:     []string{"PRIVATE_KEY_FILE"},
 			},
 			&cli.StringFlag{
+				Name:        "private-key-env",
+				Destination: &args.PrivateKeyEnv,
+				EnvVars:     []string{"PRIVATE_KEY_ENV"},
+			},
+			&cli.StringFlag{
+				Name:        "signing-command",
+				Destination: &args.SigningCommand,
+				EnvVars:     []string{"SIGNING_COMMAND"},
+			},
+			&cli.StringFlag{
+				Name:        "apps-file",
+				Destination: &args.AppsFile,
+				EnvVars:     []string{"APPS_FILE"},
+			},
+			&cli.StringSliceFlag{
 				Name:        "rules-file",
-				Destination: &args.RulesFile,
+				Destination: &args.RulesFiles,
 				EnvVars:     []string{"RULES_FILE"},
 			},
+			&cli.BoolFlag{
+				Name:        "repo-policies",
+				Destination: &args.RepoPolicies,
+				EnvVars:     []string{"REPO_POLICIES"},
+			},
+			&cli.StringFlag{
+				Name:        "repo-policy-path",
+				Destination: &args.RepoPolicyPath,
+				Value:       ".github/token-dispenser.yaml",
+				EnvVars:     []string{"REPO_POLICY_PATH"},
+			},
+			&cli.StringFlag{
+				Name:        "org-policy-repo",
+				Destination: &args.OrgPolicyRepo,
+				EnvVars:     []string{"ORG_POLICY_REPO"},
+			},
+			&cli.StringFlag{
+				Name:        "org-policy-path",
+				Destination: &args.OrgPolicyPath,
+				Value:       "token-dispenser-org.yaml",
+				EnvVars:     []string{"ORG_POLICY_PATH"},
+			},
+			&cli.StringFlag{
+				Name:        "trust-file",
+				Destination: &args.TrustFile,
+				EnvVars:     []string{"TRUST_FILE"},
+			},
+			&cli.DurationFlag{
+				Name:        "installation-cache-ttl",
+				Destination: &args.InstallationCacheTTL,
+				Value:       10 * time.Minute,
+				EnvVars:     []string{"INSTALLATION_CACHE_TTL"},
+			},
+			&cli.BoolFlag{
+				Name:        "token-cache",
+				Destination: &args.TokenCache,
+				EnvVars:     []string{"TOKEN_CACHE"},
+			},
+			&cli.DurationFlag{
+				Name:        "token-cache-min-ttl",
+				Destination: &args.TokenCacheMinTTL,
+				Value:       30 * time.Minute,
+				EnvVars:     []string{"TOKEN_CACHE_MIN_TTL"},
+			},
+			&cli.StringFlag{
+				Name:        "github-api-url",
+				Destination: &args.GitHubAPIURL,
+				EnvVars:     []string{"GITHUB_API_URL"},
+			},
+			&cli.StringFlag{
+				Name:        "oidc-issuer",
+				Destination: &args.OIDCIssuer,
+				EnvVars:     []string{"OIDC_ISSUER"},
+			},
+			&cli.IntFlag{
+				Name:        "max-retries",
+				Destination: &args.MaxRetries,
+				Value:       3,
+				EnvVars:     []string{"MAX_RETRIES"},
+			},
+			&cli.DurationFlag{
+				Name:        "retry-base-delay",
+				Destination: &args.RetryBaseDelay,
+				Value:       500 * time.Millisecond,
+				EnvVars:     []string{"RETRY_BASE_DELAY"},
+			},
+			&cli.DurationFlag{
+				Name:        "max-retry-delay",
+				Destination: &args.MaxRetryDelay,
+				Value:       30 * time.Second,
+				EnvVars:     []string{"MAX_RETRY_DELAY"},
+			},
+			&cli.IntFlag{
+				Name:        "installation-concurrency",
+				Destination: &args.InstallationConcurrency,
+				Value:       4,
+				EnvVars:     []string{"INSTALLATION_CONCURRENCY"},
+			},
+			&cli.StringSliceFlag{
+				Name:        "allow-claims",
+				Destination: &args.AllowClaims,
+				EnvVars:     []string{"ALLOW_CLAIMS"},
+			},
+			&cli.BoolFlag{
+				Name:        "explain",
+				Destination: &args.Explain,
+				EnvVars:     []string{"EXPLAIN"},
+			},
+			&cli.StringSliceFlag{
+				Name:        "explain-redact-claims",
+				Destination: &args.ExplainRedactClaims,
+				EnvVars:     []string{"EXPLAIN_REDACT_CLAIMS"},
+			},
 		},
 		Action: func(cCtx *cli.Context) error {
 			return run(args)
@@ -57,32 +188,126 @@ func main() {
 }
 
 func run(args Args) error {
-	ghClient, err := NewGitHubAppClient(args)
+	allowedClaims, err := NewAllowedClaims(args.AllowClaims.Value())
+	if err != nil {
+		return err
+	}
+
+	if len(allowedClaims) > 0 {
+		fmt.Printf("allowing claims '%s' in rules\n", strings.Join(args.AllowClaims.Value(), ", "))
+	}
+
+	appConfigs, err := getAppConfigs(args)
 	if err != nil {
-		return fmt.Errorf("couldn't create GitHub client: %w", err)
+		return err
 	}
 
-	provider, err := oidc.NewProvider(context.TODO(), githubTokenIssuer)
+	apps, err := NewAppRegistry(appConfigs, func(config AppConfig) (*GitHubAppClient, error) {
+		return NewGitHubAppClient(args, config)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't create GitHub clients: %w", err)
+	}
+
+	oidcIssuer := args.OIDCIssuer
+	if oidcIssuer == "" {
+		oidcIssuer, err = DefaultOIDCIssuer(args.GitHubAPIURL)
+		if err != nil {
+			return fmt.Errorf("couldn't determine OIDC issuer: %w", err)
+		}
+	}
+
+	provider, err := oidc.NewProvider(context.TODO(), oidcIssuer)
 	if err != nil {
 		return fmt.Errorf("couldn't create OIDC provider: %w", err)
 	}
 
+	fmt.Printf("using OIDC issuer '%s'\n", oidcIssuer)
+
 	oidcVerifier := provider.Verifier(&oidc.Config{SkipClientIDCheck: true})
 
-	var authRulesRepo AuthRuleRepository = MemRuleRepository{}
-	if args.RulesFile != "" {
-		authRulesRepo, err = NewFileRuleRepository(args.RulesFile)
+	clock := Clock(time.Now)
+
+	ruleRepos := MultiRuleRepository{}
+	if rulesFiles := args.RulesFiles.Value(); len(rulesFiles) > 0 {
+		reloadingRepo, err := NewReloadingRuleRepository(strings.Join(rulesFiles, ", "), func() (AuthRuleRepository, error) {
+			frr, err := LoadFileRuleRepository(rulesFiles, allowedClaims)
+			if err != nil {
+				return nil, err
+			}
+
+			logExpiredRules(frr.ExpiredRules(clock()))
+
+			return frr, nil
+		})
 		if err != nil {
 			return fmt.Errorf("couldn't read authorization rules from file: %w", err)
 		}
 
-		fmt.Printf("using rules file at '%s'\n", args.RulesFile)
+		go func() {
+			if err := reloadingRepo.Watch(context.Background(), rulesFiles); err != nil {
+				fmt.Printf("stopped watching rules file: %v\n", err)
+			}
+		}()
+
+		ruleRepos.Sources = append(ruleRepos.Sources, reloadingRepo)
+		fmt.Printf("using rules files at '%s'\n", strings.Join(rulesFiles, ", "))
+	}
+
+	if args.RepoPolicies {
+		ruleRepos.Sources = append(ruleRepos.Sources, NewRepoPolicyRuleRepository(apps, args.RepoPolicyPath, args.OrgPolicyRepo, args.OrgPolicyPath, allowedClaims, clock))
+		fmt.Printf("using repository policies at '%s'\n", args.RepoPolicyPath)
+
+		if args.OrgPolicyRepo != "" {
+			fmt.Printf("capping repository policies with org policies at '%s:%s'\n", args.OrgPolicyRepo, args.OrgPolicyPath)
+		}
+	}
+
+	var authRulesRepo AuthRuleRepository = MemRuleRepository{}
+	if len(ruleRepos.Sources) == 1 {
+		authRulesRepo = ruleRepos.Sources[0]
+	} else if len(ruleRepos.Sources) > 1 {
+		authRulesRepo = ruleRepos
+	}
+
+	var ownerTrust OwnerTrustPolicy
+	if args.TrustFile != "" {
+		ownerTrust, err = LoadOwnerTrustPolicy(args.TrustFile)
+		if err != nil {
+			return fmt.Errorf("couldn't read owner trust from file: %w", err)
+		}
+
+		fmt.Printf("using trust file at '%s'\n", args.TrustFile)
 	}
 
 	srv := TokenService{
-		ghClient:     ghClient,
+		apps:         apps,
 		authRules:    authRulesRepo,
+		ownerTrust:   ownerTrust,
 		oidcVerifier: oidcVerifier,
+		oidcIssuer:   oidcIssuer,
+		issuedTokens: NewIssuedTokens(),
+		clock:        clock,
+	}
+
+	if args.TokenCache {
+		srv.tokenCache = NewTokenCache(args.TokenCacheMinTTL)
+		fmt.Printf("caching tokens with a minimum remaining lifetime of %s\n", args.TokenCacheMinTTL)
+	}
+
+	if args.Explain {
+		srv.explain = true
+		srv.redactedClaims = map[GitHubClaimName]bool{}
+		for _, claim := range args.ExplainRedactClaims.Value() {
+			claimName, err := NewGitHubClaimsField(claim, allowedClaims)
+			if err != nil {
+				return fmt.Errorf("invalid claim to redact: %w", err)
+			}
+
+			srv.redactedClaims[claimName] = true
+		}
+
+		fmt.Printf("explaining decisions, redacting claims '%s'\n", strings.Join(args.ExplainRedactClaims.Value(), ", "))
 	}
 
 	httpSrv := NewHTTPServer(&srv)
@@ -94,10 +319,111 @@ func run(args Args) error {
 	return nil
 }
 
+// getAppConfigs returns the configured GitHub Apps, either from an apps file
+// or from a single app serving every owner.
+func getAppConfigs(args Args) ([]AppConfig, error) {
+	if args.AppsFile != "" {
+		configs, err := LoadAppConfigs(args.AppsFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read apps from file: %w", err)
+		}
+
+		fmt.Printf("using apps file at '%s'\n", args.AppsFile)
+		return configs, nil
+	}
+
+	if args.AppID == 0 {
+		return nil, errors.New("either --apps-file or --app-id must be set")
+	}
+
+	return []AppConfig{{
+		Owner:          "*",
+		AppID:          args.AppID,
+		PrivateKeyFile: args.PrivateKeyFile,
+		PrivateKeyEnv:  args.PrivateKeyEnv,
+		SigningCommand: args.SigningCommand,
+	}}, nil
+}
+
 type TokenService struct {
-	ghClient     *GitHubAppClient
+	apps         *AppRegistry
 	authRules    AuthRuleRepository
+	ownerTrust   OwnerTrustPolicy
 	oidcVerifier *oidc.IDTokenVerifier
+	oidcIssuer   string
+	tokenCache   *TokenCache
+	issuedTokens *IssuedTokens
+	clock        Clock
+
+	// explain enables ExplainDecision. The values of redactedClaims are never
+	// shown in explanations.
+	explain        bool
+	redactedClaims map[GitHubClaimName]bool
+}
+
+// DefaultOIDCIssuer returns the GitHub Actions OIDC issuer that goes along
+// with a GitHub API URL. GitHub Enterprise Server serves the issuer from the
+// same host as the API; github.com uses a dedicated issuer.
+func DefaultOIDCIssuer(apiURL string) (string, error) {
+	if apiURL == "" {
+		return githubTokenIssuer, nil
+	}
+
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid GitHub API URL '%s': %w", apiURL, err)
+	}
+
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid GitHub API URL '%s': must be an absolute URL such as 'https://github.example.com/api/v3'", apiURL)
+	}
+
+	if u.Host == "api.github.com" {
+		return githubTokenIssuer, nil
+	}
+
+	return fmt.Sprintf("%s://%s/_services/token", u.Scheme, u.Host), nil
+}
+
+type StatsResponse struct {
+	InstallationCache InstallationCacheStats    `json:"installation_cache"`
+	RateLimits        map[string]RateLimitStats `json:"rate_limits"`
+}
+
+func (srv *TokenService) Stats() StatsResponse {
+	stats := StatsResponse{
+		RateLimits: map[string]RateLimitStats{},
+	}
+
+	for _, client := range srv.apps.Clients() {
+		installStats := client.InstallationCacheStats()
+		stats.InstallationCache.Hits += installStats.Hits
+		stats.InstallationCache.Misses += installStats.Misses
+		stats.RateLimits[strconv.FormatInt(client.appID, 10)] = client.RateLimitStats()
+	}
+
+	return stats
+}
+
+type StatusResponse struct {
+	Rules []RulesStatus `json:"rules,omitempty"`
+}
+
+func (srv *TokenService) Status() StatusResponse {
+	var status StatusResponse
+
+	ruleRepos, ok := srv.authRules.(MultiRuleRepository)
+	if !ok {
+		ruleRepos = MultiRuleRepository{Sources: []AuthRuleRepository{srv.authRules}}
+	}
+
+	for _, authRules := range ruleRepos.Sources {
+		if reloadingRepo, ok := authRules.(*ReloadingRuleRepository); ok {
+			status.Rules = append(status.Rules, reloadingRepo.Status())
+		}
+	}
+
+	return status
 }
 
 type AuthRuleRepository interface {
@@ -106,25 +432,99 @@ type AuthRuleRepository interface {
 
 type GetTokenRequest struct {
 	Repo        string        `json:"repo"`
+	Repos       []string      `json:"repos"`
 	OIDCToken   string        `json:"token"`
 	Permissions PermissionSet `json:"permissions"`
 }
 
+// TargetRepositories returns every repository named by the request, either
+// through the single Repo field or the Repos list. Since a single installation
+// token is minted for all of them, they must share the same owner.
+func (req GetTokenRequest) TargetRepositories() ([]Repository, error) {
+	names := req.Repos
+	if req.Repo != "" {
+		names = append([]string{req.Repo}, names...)
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New("at least one repository must be included")
+	}
+
+	var repos []Repository
+	seen := map[string]bool{}
+	for _, name := range names {
+		repo, err := ParseRepository(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[repo.FullName] {
+			continue
+		}
+		seen[repo.FullName] = true
+
+		if len(repos) > 0 && repo.Owner != repos[0].Owner {
+			return nil, fmt.Errorf("all repositories must have the same owner; got '%s' and '%s'", repos[0].Owner, repo.Owner)
+		}
+
+		repos = append(repos, repo)
+	}
+
+	return repos, nil
+}
+
 type GetTokenResponse struct {
-	Token string `json:"token,omitempty"`
+	Token        string        `json:"token,omitempty"`
+	ExpiresAt    time.Time     `json:"expires_at"`
+	Permissions  PermissionSet `json:"permissions,omitempty"`
+	Repositories []string      `json:"repositories,omitempty"`
+	RuleIDs      []string      `json:"rule_ids,omitempty"`
 }
 
-func (srv *TokenService) GenerateGitHubToken(ctx context.Context, req GetTokenRequest) (GetTokenResponse, error) {
-	idToken, err := srv.oidcVerifier.Verify(ctx, req.OIDCToken)
+// NewGetTokenResponse describes an installation token as it was granted by
+// GitHub, along with the rules that authorized it.
+func NewGetTokenResponse(token *github.InstallationToken, requestedRepos []Repository, rules []AuthorizationRule) (GetTokenResponse, error) {
+	perms, err := FromInstallationPermissions(token.GetPermissions())
+	if err != nil {
+		return GetTokenResponse{}, fmt.Errorf("couldn't read granted permissions: %w", err)
+	}
+
+	repos := Map(token.Repositories, func(repo *github.Repository) string { return repo.GetFullName() })
+	if len(repos) == 0 {
+		repos = Map(requestedRepos, func(repo Repository) string { return repo.FullName })
+	}
+
+	return GetTokenResponse{
+		Token:        token.GetToken(),
+		ExpiresAt:    token.GetExpiresAt().Time,
+		Permissions:  perms,
+		Repositories: repos,
+		RuleIDs:      PublicRuleIDs(rules),
+	}, nil
+}
+
+// verifyIDToken checks that an OIDC token is valid and was issued by GitHub
+// Actions.
+func (srv *TokenService) verifyIDToken(ctx context.Context, rawIDToken string) (*oidc.IDToken, error) {
+	idToken, err := srv.oidcVerifier.Verify(ctx, rawIDToken)
 	if err != nil {
-		return GetTokenResponse{}, ErrInvalidToken.New(WithWrappedError(err))
+		return nil, ErrInvalidToken.New(WithWrappedError(err))
 	}
 
-	if idToken.Issuer != githubTokenIssuer {
-		return GetTokenResponse{}, errors.New("issuer isn't GitHub Actions")
+	if idToken.Issuer != srv.oidcIssuer {
+		return nil, ErrInvalidIssuer.New(WithWrappedError(fmt.Errorf("expected '%s', got '%s'", srv.oidcIssuer, idToken.Issuer)))
 	}
 
-	targetRepo, err := ParseRepository(req.Repo)
+	return idToken, nil
+}
+
+func (srv *TokenService) GenerateGitHubToken(ctx context.Context, req GetTokenRequest) (GetTokenResponse, error) {
+	idToken, err := srv.verifyIDToken(ctx, req.OIDCToken)
+	if err != nil {
+		return GetTokenResponse{}, err
+	}
+
+	targetRepos, err := req.TargetRepositories()
 	if err != nil {
 		return GetTokenResponse{}, fmt.Errorf("invalid repository: %w", err)
 	}
@@ -133,48 +533,196 @@ func (srv *TokenService) GenerateGitHubToken(ctx context.Context, req GetTokenRe
 		return GetTokenResponse{}, errors.New("permissions must be included")
 	}
 
+	if err := req.Permissions.Validate(); err != nil {
+		return GetTokenResponse{}, err
+	}
+
 	var claims GitHubClaims
 	if err := idToken.Claims(&claims); err != nil {
 		return GetTokenResponse{}, fmt.Errorf("could not extract GitHub custom claims: %w", err)
 	}
 
-	if claims.RepositoryOwner != targetRepo.Owner {
-		return GetTokenResponse{}, errors.New("caller must have same owner as target")
+	if !srv.ownerTrust.Allows(claims, targetRepos[0].Owner) {
+		return GetTokenResponse{}, ErrUntrustedOwner.New(
+			WithWrappedError(fmt.Errorf("'%s' (%s) requested a token for '%s'", claims.RepositoryOwner, claims.RepositoryOwnerID, targetRepos[0].Owner)),
+		)
 	}
 
-	rules, err := srv.authRules.GetRulesForRepo(ctx, targetRepo)
-	if err != nil {
-		return GetTokenResponse{}, fmt.Errorf("could not get rules for repository: %w", err)
-	}
+	var authorizingRules, denyingRules []AuthorizationRule
+	var repoPerms []PermissionSet
+	for _, targetRepo := range targetRepos {
+		rules, targetRepo, err := srv.getRulesForRepo(ctx, targetRepo)
+		if err != nil {
+			return GetTokenResponse{}, err
+		}
 
-	if !claims.MatchesAnyRule(rules) {
-		return GetTokenResponse{}, fmt.Errorf("caller is not authorized to generate a token for repo %s", req.Repo)
+		decision := claims.EvaluateRules(targetRepo, rules, srv.clock)
+		if decision.BlockedBy != nil {
+			return GetTokenResponse{}, ErrRequestDenied.New(
+				WithWrappedError(fmt.Errorf("repo %s, rule %s at %s", targetRepo.FullName, decision.BlockedBy.Describe(), decision.BlockedBy.Source)),
+				WithExternalMessage(fmt.Sprintf("requests for repo %s are denied by rule %s", targetRepo.FullName, decision.BlockedBy.PublicDescribe())),
+				WithRuleIDs(PublicRuleIDs([]AuthorizationRule{*decision.BlockedBy})...),
+			)
+		}
+
+		if !decision.IsAllowed() {
+			return GetTokenResponse{}, ErrNotAuthorized.New(
+				WithWrappedError(fmt.Errorf("repo %s, deny rules %s", targetRepo.FullName, strings.Join(RuleIDs(decision.DenyRules), ", "))),
+				WithExternalMessage(fmt.Sprintf("caller is not authorized to generate a token for repo %s", targetRepo.FullName)),
+				WithRuleIDs(PublicRuleIDs(decision.DenyRules)...),
+			)
+		}
+
+		authorizingRules = append(authorizingRules, decision.AllowRules...)
+		denyingRules = append(denyingRules, decision.DenyRules...)
+		repoPerms = append(repoPerms, decision.Permissions)
 	}
 
-	matchingRules := claims.GetMatchingRules(rules)
-	perms := Map(matchingRules, func(rule AuthorizationRule) PermissionSet { return rule.Permissions })
-	maxPerms := MergePermissions(perms)
+	maxPerms := IntersectPermissions(repoPerms)
+
+	// Both the rules that granted permissions and the ones that took some
+	// away decide what may be requested.
+	decidingRules := append(authorizingRules, denyingRules...)
+	decidingRuleIDs := PublicRuleIDs(decidingRules)
 
 	for requestedPerm, requestedAccessLevel := range req.Permissions {
 		maxAccessLevel, ok := maxPerms[requestedPerm]
 		if !ok {
-			return GetTokenResponse{}, fmt.Errorf("permission '%s' is not allowed ", requestedPerm)
+			return GetTokenResponse{}, ErrInvalidPermissions.New(
+				WithWrappedError(fmt.Errorf("permission '%s' isn't granted by rules %s", requestedPerm, strings.Join(RuleIDs(decidingRules), ", "))),
+				WithExternalMessage(fmt.Sprintf("permission '%s' is not allowed", requestedPerm)),
+				WithRuleIDs(decidingRuleIDs...),
+			)
 		}
 
 		if requestedAccessLevel.GreaterThan(maxAccessLevel) {
 			err := ErrInvalidPermissions.New(
 				WithExternalMessage(fmt.Sprintf("permission '%s' may only be requested at access level '%s' and below", requestedPerm, maxAccessLevel)),
+				WithRuleIDs(decidingRuleIDs...),
 			)
 			return GetTokenResponse{}, err
 		}
 	}
 
-	installToken, err := srv.ghClient.GetInstallationToken(ctx, targetRepo, req.Permissions)
+	installToken, err := srv.getInstallationToken(ctx, targetRepos, req.Permissions)
 	if err != nil {
 		return GetTokenResponse{}, fmt.Errorf("couldn't get install token: %w", err)
 	}
 
-	fmt.Println("Sending install token!")
+	res, err := NewGetTokenResponse(installToken, targetRepos, authorizingRules)
+	if err != nil {
+		return GetTokenResponse{}, err
+	}
+
+	srv.issuedTokens.Record(installToken, targetRepos[0].Owner, NewTokenHolder(claims))
+
+	if IsCrossOwner(claims, targetRepos[0].Owner) {
+		fmt.Printf("Sending cross-owner install token! source owner '%s' (%s), target owner '%s', rules %s\n", claims.RepositoryOwner, claims.RepositoryOwnerID, targetRepos[0].Owner, strings.Join(RuleIDs(authorizingRules), ", "))
+	} else {
+		fmt.Printf("Sending install token! rules %s\n", strings.Join(RuleIDs(authorizingRules), ", "))
+	}
+
+	return res, nil
+}
+
+// getRulesForRepo returns the rules for a repository. If any of their
+// conditions refers to the default branch, the repository is returned with it.
+func (srv *TokenService) getRulesForRepo(ctx context.Context, repo Repository) ([]AuthorizationRule, Repository, error) {
+	rules, err := srv.authRules.GetRulesForRepo(ctx, repo)
+	if err != nil {
+		return nil, repo, fmt.Errorf("could not get rules for repository: %w", err)
+	}
+
+	if !Any(rules, func(rule AuthorizationRule) bool { return rule.Condition != nil && rule.Condition.UsesDefaultBranch }) {
+		return rules, repo, nil
+	}
+
+	ghClient, err := srv.apps.ClientForOwner(repo.Owner)
+	if err != nil {
+		return nil, repo, err
+	}
+
+	repo.DefaultBranch, err = ghClient.GetDefaultBranch(ctx, repo)
+	if err != nil {
+		return nil, repo, fmt.Errorf("could not get default branch for conditions: %w", err)
+	}
+
+	return rules, repo, nil
+}
+
+// getInstallationToken mints an installation token, going through the token
+// cache if one is configured. Callers must be authorized beforehand.
+func (srv *TokenService) getInstallationToken(ctx context.Context, repos []Repository, perms PermissionSet) (*github.InstallationToken, error) {
+	ghClient, err := srv.apps.ClientForOwner(repos[0].Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	if srv.tokenCache == nil {
+		return ghClient.GetInstallationToken(ctx, repos, perms)
+	}
+
+	return srv.tokenCache.GetOrCreate(ctx, TokenCacheKey(repos, perms), func(ctx context.Context) (*github.InstallationToken, error) {
+		return ghClient.GetInstallationToken(ctx, repos, perms)
+	})
+}
+
+type RevokeTokenRequest struct {
+	OIDCToken string `json:"token"`
+	Token     string `json:"installation_token"`
+}
+
+// RevokeGitHubToken revokes an installation token on behalf of a workflow, so
+// that it doesn't stay valid for longer than the job that requested it. Only
+// the workflow run a token was issued to may revoke it.
+func (srv *TokenService) RevokeGitHubToken(ctx context.Context, req RevokeTokenRequest) error {
+	idToken, err := srv.verifyIDToken(ctx, req.OIDCToken)
+	if err != nil {
+		return err
+	}
+
+	if req.Token == "" {
+		return ErrMissingInstallationToken.New()
+	}
 
-	return GetTokenResponse{Token: installToken}, nil
+	var claims GitHubClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return fmt.Errorf("could not extract GitHub custom claims: %w", err)
+	}
+
+	holder := NewTokenHolder(claims)
+	owner, err := srv.issuedTokens.Release(req.Token, holder)
+	if err != nil {
+		return ErrTokenNotIssuedToCaller.New(WithWrappedError(err))
+	}
+
+	// A cached token may have been handed out to other callers, which may
+	// still be using it. It's only revoked once the last of them is done.
+	if srv.tokenCache != nil && !srv.tokenCache.Release(req.Token) {
+		fmt.Println("Released install token, which other callers still hold!")
+		return nil
+	}
+
+	ghClient, err := srv.apps.ClientForOwner(owner)
+	if err == nil {
+		err = ghClient.RevokeInstallationToken(ctx, req.Token)
+	}
+
+	if err != nil {
+		srv.issuedTokens.Restore(req.Token, holder)
+		if srv.tokenCache != nil {
+			srv.tokenCache.Restore(req.Token)
+		}
+
+		return err
+	}
+
+	srv.issuedTokens.Forget(req.Token)
+	if srv.tokenCache != nil {
+		srv.tokenCache.Evict(req.Token)
+	}
+
+	fmt.Println("Revoked install token!")
+
+	return nil
 }
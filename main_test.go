@@ -0,0 +1,741 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-test/deep"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/go-github/v53/github"
+)
+
+func TestGetTokenRequest_TargetRepositories(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     GetTokenRequest
+		want    []Repository
+		wantErr bool
+	}{
+		{
+			name: "Uses the single repo field",
+			req:  GetTokenRequest{Repo: "terrabitz/foo"},
+			want: []Repository{
+				{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"},
+			},
+		},
+		{
+			name: "Combines and deduplicates repo and repos",
+			req: GetTokenRequest{
+				Repo:  "terrabitz/foo",
+				Repos: []string{"terrabitz/bar", "terrabitz/foo"},
+			},
+			want: []Repository{
+				{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"},
+				{Owner: "terrabitz", Name: "bar", FullName: "terrabitz/bar"},
+			},
+		},
+		{
+			name:    "Returns error if no repositories are given",
+			req:     GetTokenRequest{},
+			wantErr: true,
+		},
+		{
+			name: "Returns error if repositories have different owners",
+			req: GetTokenRequest{
+				Repos: []string{"terrabitz/foo", "example/bar"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.req.TargetRepositories()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TargetRepositories() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestNewGetTokenResponse(t *testing.T) {
+	expiresAt := time.Date(2023, 6, 1, 13, 0, 0, 0, time.UTC)
+	requestedRepos := []Repository{{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"}}
+
+	tests := []struct {
+		name  string
+		token *github.InstallationToken
+		rules []AuthorizationRule
+		want  GetTokenResponse
+	}{
+		{
+			name: "Describes the token as granted by GitHub",
+			token: &github.InstallationToken{
+				Token:     github.String("ghs_test"),
+				ExpiresAt: &github.Timestamp{Time: expiresAt},
+				Permissions: &github.InstallationPermissions{
+					Contents: github.String("read"),
+					Metadata: github.String("read"),
+				},
+				Repositories: []*github.Repository{
+					{FullName: github.String("terrabitz/foo")},
+				},
+			},
+			rules: []AuthorizationRule{
+				{ID: "terrabitz/foo#0"},
+				{ID: "terrabitz/foo#1"},
+				{ID: "terrabitz/foo#0"},
+			},
+			want: GetTokenResponse{
+				Token:     "ghs_test",
+				ExpiresAt: expiresAt,
+				Permissions: PermissionSet{
+					"contents": GitHubAccessLevelRead,
+					"metadata": GitHubAccessLevelRead,
+				},
+				Repositories: []string{"terrabitz/foo"},
+				RuleIDs:      []string{"terrabitz/foo#0", "terrabitz/foo#1"},
+			},
+		},
+		{
+			name: "Falls back to the requested repositories",
+			token: &github.InstallationToken{
+				Token:     github.String("ghs_test"),
+				ExpiresAt: &github.Timestamp{Time: expiresAt},
+			},
+			want: GetTokenResponse{
+				Token:        "ghs_test",
+				ExpiresAt:    expiresAt,
+				Permissions:  PermissionSet{},
+				Repositories: []string{"terrabitz/foo"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewGetTokenResponse(tt.token, requestedRepos, tt.rules)
+			if err != nil {
+				t.Fatalf("NewGetTokenResponse() error = %v", err)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDefaultOIDCIssuer(t *testing.T) {
+	tests := []struct {
+		name    string
+		apiURL  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Uses the GitHub Actions issuer by default",
+			want: githubTokenIssuer,
+		},
+		{
+			name:   "Uses the GitHub Actions issuer for github.com",
+			apiURL: "https://api.github.com/",
+			want:   githubTokenIssuer,
+		},
+		{
+			name:   "Uses the GHES host for GitHub Enterprise Server",
+			apiURL: "https://github.example.com/api/v3",
+			want:   "https://github.example.com/_services/token",
+		},
+		{
+			name:    "Returns error for an invalid URL",
+			apiURL:  "://github.example.com",
+			wantErr: true,
+		},
+		{
+			name:    "Returns error for a URL without a scheme",
+			apiURL:  "ghes.example.com/api/v3",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DefaultOIDCIssuer(tt.apiURL)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DefaultOIDCIssuer() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("DefaultOIDCIssuer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestTokenService returns a service whose GitHub Apps talk to a fake
+// GitHub API served by the given handler, along with a function that signs
+// OIDC tokens the service accepts.
+func newTestTokenService(t *testing.T, handler http.Handler) (*TokenService, func(claims jwt.MapClaims) string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keySet := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&key.PublicKey}}
+	sign := func(claims jwt.MapClaims) string {
+		claims["iss"] = githubTokenIssuer
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return token
+	}
+
+	apps, err := NewAppRegistry([]AppConfig{{Owner: "*", AppID: 1}}, func(AppConfig) (*GitHubAppClient, error) {
+		return newTestGitHubAppClient(t, handler), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &TokenService{
+		apps:         apps,
+		oidcVerifier: oidc.NewVerifier(githubTokenIssuer, keySet, &oidc.Config{SkipClientIDCheck: true}),
+		oidcIssuer:   githubTokenIssuer,
+		issuedTokens: NewIssuedTokens(),
+		clock:        time.Now,
+	}, sign
+}
+
+// fakeRevokeHandler serves GitHub's token revocation endpoint, counting
+// revocations and failing them while fail is set.
+func fakeRevokeHandler(revokes *atomic.Int64, fail *atomic.Bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/installation/token", func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"message": "Server Error"}`)
+			return
+		}
+
+		revokes.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+func TestTokenService_RevokeGitHubToken(t *testing.T) {
+	issuedTo := TokenHolder{Repository: "terrabitz/foo", RunID: "1"}
+
+	tests := []struct {
+		name        string
+		token       string
+		claims      jwt.MapClaims
+		failRevoke  bool
+		wantErr     error
+		wantRevokes int64
+		wantIssued  bool
+	}{
+		{
+			name:        "Revokes a token for the run it was issued to",
+			token:       "ghs_issued",
+			claims:      jwt.MapClaims{"repository": "terrabitz/foo", "run_id": "1"},
+			wantRevokes: 1,
+		},
+		{
+			name:       "Rejects a token issued to another run",
+			token:      "ghs_issued",
+			claims:     jwt.MapClaims{"repository": "terrabitz/foo", "run_id": "2"},
+			wantErr:    &ErrTokenNotIssuedToCaller,
+			wantIssued: true,
+		},
+		{
+			name:       "Rejects a token issued to another repository",
+			token:      "ghs_issued",
+			claims:     jwt.MapClaims{"repository": "terrabitz/bar", "run_id": "1"},
+			wantErr:    &ErrTokenNotIssuedToCaller,
+			wantIssued: true,
+		},
+		{
+			name:       "Rejects a token the dispenser didn't issue",
+			token:      "ghs_other",
+			claims:     jwt.MapClaims{"repository": "terrabitz/foo", "run_id": "1"},
+			wantErr:    &ErrTokenNotIssuedToCaller,
+			wantIssued: true,
+		},
+		{
+			name:       "Keeps the token if GitHub fails to revoke it",
+			token:      "ghs_issued",
+			claims:     jwt.MapClaims{"repository": "terrabitz/foo", "run_id": "1"},
+			failRevoke: true,
+			wantErr:    errors.New("any"),
+			wantIssued: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var revokes atomic.Int64
+			var fail atomic.Bool
+			fail.Store(tt.failRevoke)
+
+			srv, sign := newTestTokenService(t, fakeRevokeHandler(&revokes, &fail))
+			srv.tokenCache = NewTokenCache(time.Minute)
+
+			issued := &github.InstallationToken{
+				Token:     github.String("ghs_issued"),
+				ExpiresAt: &github.Timestamp{Time: time.Now().Add(time.Hour)},
+			}
+			srv.tokenCache.tokens["key"] = issued
+			srv.issuedTokens.Record(issued, "terrabitz", issuedTo)
+
+			err := srv.RevokeGitHubToken(context.Background(), RevokeTokenRequest{
+				OIDCToken: sign(tt.claims),
+				Token:     tt.token,
+			})
+			if (err != nil) != (tt.wantErr != nil) {
+				t.Fatalf("RevokeGitHubToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var appErr *Error
+			if wantAppErr, ok := tt.wantErr.(*Error); ok && (!errors.As(err, &appErr) || appErr.InternalMessage != wantAppErr.InternalMessage) {
+				t.Errorf("RevokeGitHubToken() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if got := revokes.Load(); got != tt.wantRevokes {
+				t.Errorf("revoked %d tokens, want %d", got, tt.wantRevokes)
+			}
+
+			issuedToken, gotIssued := srv.issuedTokens.tokens["ghs_issued"]
+			if gotIssued != tt.wantIssued || (gotIssued && issuedToken.holders[issuedTo] != 1) {
+				t.Errorf("token still issued = %v, want %v", gotIssued, tt.wantIssued)
+			}
+
+			if _, gotCached := srv.tokenCache.tokens["key"]; gotCached != tt.wantIssued {
+				t.Errorf("token still cached = %v, want %v", gotCached, tt.wantIssued)
+			}
+		})
+	}
+}
+
+func TestTokenService_RevokeGitHubToken_SharedToken(t *testing.T) {
+	var revokes atomic.Int64
+	var fail atomic.Bool
+
+	srv, sign := newTestTokenService(t, fakeRevokeHandler(&revokes, &fail))
+	srv.tokenCache = NewTokenCache(time.Minute)
+
+	issued := &github.InstallationToken{
+		Token:     github.String("ghs_issued"),
+		ExpiresAt: &github.Timestamp{Time: time.Now().Add(time.Hour)},
+	}
+	create := func(context.Context) (*github.InstallationToken, error) { return issued, nil }
+
+	// Two legs of a matrix get the same token from the cache
+	holder := TokenHolder{Repository: "terrabitz/foo", RunID: "1"}
+	for i := 0; i < 2; i++ {
+		token, err := srv.tokenCache.GetOrCreate(context.Background(), "key", create)
+		if err != nil {
+			t.Fatalf("GetOrCreate() error = %v", err)
+		}
+
+		srv.issuedTokens.Record(token, "terrabitz", holder)
+	}
+
+	req := RevokeTokenRequest{
+		OIDCToken: sign(jwt.MapClaims{"repository": "terrabitz/foo", "run_id": "1"}),
+		Token:     "ghs_issued",
+	}
+
+	if err := srv.RevokeGitHubToken(context.Background(), req); err != nil {
+		t.Fatalf("RevokeGitHubToken() error = %v", err)
+	}
+	if got := revokes.Load(); got != 0 {
+		t.Errorf("revoked a token another leg still holds")
+	}
+
+	if err := srv.RevokeGitHubToken(context.Background(), req); err != nil {
+		t.Fatalf("RevokeGitHubToken() error = %v", err)
+	}
+	if got := revokes.Load(); got != 1 {
+		t.Errorf("revoked %d tokens once every leg released it, want 1", got)
+	}
+
+	if err := srv.RevokeGitHubToken(context.Background(), req); err == nil {
+		t.Errorf("RevokeGitHubToken() revoked a token that's no longer held")
+	}
+}
+
+func TestTokenService_Status(t *testing.T) {
+	var sources []AuthRuleRepository
+	for _, file := range []string{"./testdata/auth_rule_patterns.yaml", "./testdata/auth_rule_ids.yaml"} {
+		file := file
+		reloadingRepo, err := NewReloadingRuleRepository(file, func() (AuthRuleRepository, error) {
+			return NewFileRuleRepository(file)
+		})
+		if err != nil {
+			t.Fatalf("NewReloadingRuleRepository() error = %v", err)
+		}
+
+		sources = append(sources, reloadingRepo)
+	}
+
+	srv := TokenService{authRules: MultiRuleRepository{Sources: sources}}
+
+	gotSources := Map(srv.Status().Rules, func(status RulesStatus) string { return status.Source })
+	wantSources := []string{"./testdata/auth_rule_patterns.yaml", "./testdata/auth_rule_ids.yaml"}
+	if diff := deep.Equal(gotSources, wantSources); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// staticRuleRepository serves the same rules for every repository.
+type staticRuleRepository []AuthorizationRule
+
+func (rules staticRuleRepository) GetRulesForRepo(context.Context, Repository) ([]AuthorizationRule, error) {
+	return rules, nil
+}
+
+func TestTokenService_getRulesForRepo(t *testing.T) {
+	mustCondition := func(expression string) *Condition {
+		condition, err := NewCondition(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return condition
+	}
+
+	tests := []struct {
+		name           string
+		condition      *Condition
+		wantBranch     string
+		wantRepoGets   int64
+		wantTokenPerms string
+	}{
+		{
+			name:      "Doesn't look up the default branch for other conditions",
+			condition: mustCondition(`claims.ref_type == "tag"`),
+		},
+		{
+			name:           "Looks up the default branch once with a metadata token",
+			condition:      mustCondition(`claims.ref == "refs/heads/" + repo.default_branch`),
+			wantBranch:     "trunk",
+			wantRepoGets:   1,
+			wantTokenPerms: `{"metadata":"read"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var repoGets atomic.Int64
+			var tokenPerms atomic.Value
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/terrabitz/foo/installation", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"id": 1}`)
+			})
+			mux.HandleFunc("/app/installations/1/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+				var opts struct {
+					Permissions json.RawMessage `json:"permissions"`
+				}
+				json.NewDecoder(r.Body).Decode(&opts)
+				tokenPerms.Store(string(opts.Permissions))
+
+				fmt.Fprint(w, `{"token": "ghs_reader", "expires_at": "2099-01-01T00:00:00Z"}`)
+			})
+			mux.HandleFunc("/repos/terrabitz/foo", func(w http.ResponseWriter, r *http.Request) {
+				repoGets.Add(1)
+				fmt.Fprint(w, `{"full_name": "terrabitz/foo", "default_branch": "trunk"}`)
+			})
+
+			srv, _ := newTestTokenService(t, mux)
+			srv.authRules = staticRuleRepository{{ID: "conditional", Condition: tt.condition}}
+
+			repo := Repository{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"}
+			for i := 0; i < 2; i++ {
+				_, got, err := srv.getRulesForRepo(context.Background(), repo)
+				if err != nil {
+					t.Fatalf("getRulesForRepo() error = %v", err)
+				}
+				if got.DefaultBranch != tt.wantBranch {
+					t.Errorf("DefaultBranch = %q, want %q", got.DefaultBranch, tt.wantBranch)
+				}
+			}
+
+			if got := repoGets.Load(); got != tt.wantRepoGets {
+				t.Errorf("looked up the repository %d times, want %d", got, tt.wantRepoGets)
+			}
+			if got, _ := tokenPerms.Load().(string); got != tt.wantTokenPerms {
+				t.Errorf("minted a token with permissions %s, want %s", got, tt.wantTokenPerms)
+			}
+		})
+	}
+}
+
+// mapRuleRepository serves rules by repository name.
+type mapRuleRepository map[string][]AuthorizationRule
+
+func (rules mapRuleRepository) GetRulesForRepo(_ context.Context, repo Repository) ([]AuthorizationRule, error) {
+	return rules[repo.FullName], nil
+}
+
+// fakeTokenHandler serves a GitHub App installed on every repository, which
+// mints installation tokens with exactly the requested permissions.
+func fakeTokenHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 1}`)
+	})
+	mux.HandleFunc("/app/installations/1/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		var opts struct {
+			Permissions json.RawMessage `json:"permissions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"token":       "ghs_test",
+			"expires_at":  "2099-01-01T00:00:00Z",
+			"permissions": opts.Permissions,
+		})
+	})
+
+	return mux
+}
+
+func TestTokenService_GenerateGitHubToken(t *testing.T) {
+	allow := func(id string, perms PermissionSet) AuthorizationRule {
+		return AuthorizationRule{
+			ID:          id,
+			Claims:      map[GitHubClaimName][]Wildcard{"repository_owner": NewWildcards("*")},
+			Permissions: perms,
+		}
+	}
+	deny := func(id string, perms PermissionSet) AuthorizationRule {
+		rule := allow(id, perms)
+		rule.Deny = true
+		return rule
+	}
+	sensitive := func(rule AuthorizationRule) AuthorizationRule {
+		rule.Sensitive = true
+		rule.Owner = "security-team"
+		return rule
+	}
+
+	rules := mapRuleRepository{
+		"terrabitz/foo": {
+			allow("foo-write", PermissionSet{"contents": GitHubAccessLevelWrite, "issues": GitHubAccessLevelWrite}),
+		},
+		"terrabitz/bar": {
+			allow("bar-read", PermissionSet{"contents": GitHubAccessLevelRead, "issues": GitHubAccessLevelWrite}),
+		},
+		"terrabitz/stripped": {
+			allow("stripped-write", PermissionSet{"contents": GitHubAccessLevelWrite}),
+			deny("stripped-deny", PermissionSet{"contents": GitHubAccessLevelWrite}),
+		},
+		"terrabitz/blocked": {
+			allow("blocked-write", PermissionSet{"contents": GitHubAccessLevelWrite}),
+			deny("blocked-deny", nil),
+		},
+		"example/foo": {
+			allow("example-read", PermissionSet{"contents": GitHubAccessLevelRead}),
+		},
+		"terrabitz/deny-only": {
+			deny("deny-only-write", PermissionSet{"contents": GitHubAccessLevelWrite}),
+		},
+		"terrabitz/sensitive": {
+			sensitive(allow("sensitive-write", PermissionSet{"contents": GitHubAccessLevelWrite})),
+			allow("public-read", PermissionSet{"contents": GitHubAccessLevelRead}),
+		},
+		"terrabitz/sensitive-blocked": {
+			allow("public-write", PermissionSet{"contents": GitHubAccessLevelWrite}),
+			sensitive(deny("sensitive-deny", nil)),
+		},
+	}
+
+	tests := []struct {
+		name        string
+		owner       string
+		trust       OwnerTrustPolicy
+		req         GetTokenRequest
+		want        GetTokenResponse
+		wantErr     *Error
+		wantRuleIDs []string
+	}{
+		{
+			name: "Grants the requested permissions",
+			req: GetTokenRequest{
+				Repo:        "terrabitz/foo",
+				Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+			},
+			want: GetTokenResponse{
+				Token:        "ghs_test",
+				ExpiresAt:    time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+				Permissions:  PermissionSet{"contents": GitHubAccessLevelWrite},
+				Repositories: []string{"terrabitz/foo"},
+				RuleIDs:      []string{"foo-write"},
+			},
+		},
+		{
+			name: "Grants what every repository allows",
+			req: GetTokenRequest{
+				Repos:       []string{"terrabitz/foo", "terrabitz/bar"},
+				Permissions: PermissionSet{"contents": GitHubAccessLevelRead, "issues": GitHubAccessLevelWrite},
+			},
+			want: GetTokenResponse{
+				Token:        "ghs_test",
+				ExpiresAt:    time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+				Permissions:  PermissionSet{"contents": GitHubAccessLevelRead, "issues": GitHubAccessLevelWrite},
+				Repositories: []string{"terrabitz/foo", "terrabitz/bar"},
+				RuleIDs:      []string{"foo-write", "bar-read"},
+			},
+		},
+		{
+			name: "Rejects more than one of the repositories allows",
+			req: GetTokenRequest{
+				Repos:       []string{"terrabitz/foo", "terrabitz/bar"},
+				Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+			},
+			wantErr:     &ErrInvalidPermissions,
+			wantRuleIDs: []string{"foo-write", "bar-read"},
+		},
+		{
+			name: "Rejects permissions a deny rule strips",
+			req: GetTokenRequest{
+				Repo:        "terrabitz/stripped",
+				Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+			},
+			wantErr:     &ErrInvalidPermissions,
+			wantRuleIDs: []string{"stripped-write", "stripped-deny"},
+		},
+		{
+			name: "Rejects callers a deny rule blocks",
+			req: GetTokenRequest{
+				Repo:        "terrabitz/blocked",
+				Permissions: PermissionSet{"contents": GitHubAccessLevelRead},
+			},
+			wantErr:     &ErrRequestDenied,
+			wantRuleIDs: []string{"blocked-deny"},
+		},
+		{
+			name: "Rejects callers no rule authorizes",
+			req: GetTokenRequest{
+				Repo:        "terrabitz/unknown",
+				Permissions: PermissionSet{"contents": GitHubAccessLevelRead},
+			},
+			wantErr: &ErrNotAuthorized,
+		},
+		{
+			name: "Reports the deny rules that left the caller without permissions",
+			req: GetTokenRequest{
+				Repo:        "terrabitz/deny-only",
+				Permissions: PermissionSet{"contents": GitHubAccessLevelRead},
+			},
+			wantErr:     &ErrNotAuthorized,
+			wantRuleIDs: []string{"deny-only-write"},
+		},
+		{
+			name: "Hides the IDs of sensitive rules that grant permissions",
+			req: GetTokenRequest{
+				Repo:        "terrabitz/sensitive",
+				Permissions: PermissionSet{"contents": GitHubAccessLevelWrite},
+			},
+			want: GetTokenResponse{
+				Token:        "ghs_test",
+				ExpiresAt:    time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+				Permissions:  PermissionSet{"contents": GitHubAccessLevelWrite},
+				Repositories: []string{"terrabitz/sensitive"},
+				RuleIDs:      []string{redacted, "public-read"},
+			},
+		},
+		{
+			name: "Hides the ID of a sensitive rule that blocks the caller",
+			req: GetTokenRequest{
+				Repo:        "terrabitz/sensitive-blocked",
+				Permissions: PermissionSet{"contents": GitHubAccessLevelRead},
+			},
+			wantErr:     &ErrRequestDenied,
+			wantRuleIDs: []string{redacted},
+		},
+		{
+			name: "Rejects an untrusted cross-owner request",
+			req: GetTokenRequest{
+				Repo:        "example/foo",
+				Permissions: PermissionSet{"contents": GitHubAccessLevelRead},
+			},
+			wantErr: &ErrUntrustedOwner,
+		},
+		{
+			name: "Grants a trusted cross-owner request",
+			trust: OwnerTrustPolicy{Trusts: []OwnerTrust{{
+				SourceOwners: SingleOrMulti{"terrabitz"},
+				TargetOwners: SingleOrMulti{"example"},
+			}}},
+			req: GetTokenRequest{
+				Repo:        "example/foo",
+				Permissions: PermissionSet{"contents": GitHubAccessLevelRead},
+			},
+			want: GetTokenResponse{
+				Token:        "ghs_test",
+				ExpiresAt:    time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC),
+				Permissions:  PermissionSet{"contents": GitHubAccessLevelRead},
+				Repositories: []string{"example/foo"},
+				RuleIDs:      []string{"example-read"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, sign := newTestTokenService(t, fakeTokenHandler())
+			srv.authRules = rules
+			srv.ownerTrust = tt.trust
+
+			tt.req.OIDCToken = sign(jwt.MapClaims{
+				"repository":       "terrabitz/caller",
+				"repository_owner": "terrabitz",
+				"run_id":           "1",
+			})
+
+			got, err := srv.GenerateGitHubToken(context.Background(), tt.req)
+			if tt.wantErr != nil {
+				var appErr *Error
+				if !errors.As(err, &appErr) || appErr.InternalMessage != tt.wantErr.InternalMessage {
+					t.Fatalf("GenerateGitHubToken() error = %v, want %v", err, tt.wantErr)
+				}
+				if diff := deep.Equal(appErr.RuleIDs, tt.wantRuleIDs); diff != nil {
+					t.Errorf("RuleIDs: %v", diff)
+				}
+				if strings.Contains(appErr.ExternalMessage, "sensitive-deny") || strings.Contains(appErr.ExternalMessage, "security-team") {
+					t.Errorf("ExternalMessage = %q reveals a sensitive rule", appErr.ExternalMessage)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GenerateGitHubToken() error = %v", err)
+			}
+
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
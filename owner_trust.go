@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OwnerTrust lets callers from the given source owners request tokens for
+// repositories under the given target owners. Source owners may be named, or
+// identified by their immutable owner ID so that a rename doesn't carry trust
+// over to whoever takes the old name.
+type OwnerTrust struct {
+	SourceOwners   SingleOrMulti `yaml:"source_owners"`
+	SourceOwnerIDs SingleOrMulti `yaml:"source_owner_ids"`
+	TargetOwners   SingleOrMulti `yaml:"target_owners"`
+}
+
+// OwnerTrustPolicy decides which callers may request tokens for repositories
+// with a different owner than their own. Callers can always request tokens
+// for their own owner.
+type OwnerTrustPolicy struct {
+	Trusts []OwnerTrust
+}
+
+func LoadOwnerTrustPolicy(file string) (OwnerTrustPolicy, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return OwnerTrustPolicy{}, fmt.Errorf("couldn't read file '%s': %w", file, err)
+	}
+
+	var trusts []OwnerTrust
+	if err := yaml.Unmarshal(b, &trusts); err != nil {
+		return OwnerTrustPolicy{}, fmt.Errorf("couldn't parse file '%s': %w", file, err)
+	}
+
+	for i, trust := range trusts {
+		if len(trust.SourceOwners) == 0 && len(trust.SourceOwnerIDs) == 0 {
+			return OwnerTrustPolicy{}, fmt.Errorf("trust %d must have at least one source owner or source owner ID", i)
+		}
+
+		if len(trust.TargetOwners) == 0 {
+			return OwnerTrustPolicy{}, fmt.Errorf("trust %d must have at least one target owner", i)
+		}
+	}
+
+	return OwnerTrustPolicy{Trusts: trusts}, nil
+}
+
+// IsCrossOwner reports whether the caller's owner differs from the target
+// owner.
+func IsCrossOwner(claims GitHubClaims, targetOwner string) bool {
+	return !strings.EqualFold(claims.RepositoryOwner, targetOwner)
+}
+
+// Allows reports whether the caller may request tokens for repositories under
+// the target owner.
+func (policy OwnerTrustPolicy) Allows(claims GitHubClaims, targetOwner string) bool {
+	if !IsCrossOwner(claims, targetOwner) {
+		return true
+	}
+
+	return Any(policy.Trusts, func(trust OwnerTrust) bool {
+		return trust.trustsSource(claims) && containsFold(trust.TargetOwners, targetOwner)
+	})
+}
+
+func (trust OwnerTrust) trustsSource(claims GitHubClaims) bool {
+	if containsFold(trust.SourceOwners, claims.RepositoryOwner) {
+		return true
+	}
+
+	return claims.RepositoryOwnerID != "" && Any(trust.SourceOwnerIDs, func(id string) bool {
+		return id == claims.RepositoryOwnerID
+	})
+}
+
+func containsFold(ss []string, s string) bool {
+	return Any(ss, func(candidate string) bool { return strings.EqualFold(candidate, s) })
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestLoadOwnerTrustPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{
+			name: "Parses a trust file",
+			file: "./testdata/owner_trust.yaml",
+		},
+		{
+			name:    "Returns error for a trust without target owners",
+			file:    "./testdata/owner_trust_no_target.yaml",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadOwnerTrustPolicy(tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadOwnerTrustPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOwnerTrustPolicy_Allows(t *testing.T) {
+	policy, err := LoadOwnerTrustPolicy("./testdata/owner_trust.yaml")
+	if err != nil {
+		t.Fatalf("LoadOwnerTrustPolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		policy      OwnerTrustPolicy
+		claims      GitHubClaims
+		targetOwner string
+		want        bool
+	}{
+		{
+			name:        "Allows the same owner by default",
+			claims:      GitHubClaims{RepositoryOwner: "terrabitz"},
+			targetOwner: "terrabitz",
+			want:        true,
+		},
+		{
+			name:        "Rejects a different owner by default",
+			claims:      GitHubClaims{RepositoryOwner: "terrabitz-forks"},
+			targetOwner: "terrabitz",
+			want:        false,
+		},
+		{
+			name:        "Allows a trusted source owner",
+			policy:      policy,
+			claims:      GitHubClaims{RepositoryOwner: "Terrabitz-Forks"},
+			targetOwner: "terrabitz",
+			want:        true,
+		},
+		{
+			name:        "Allows a trusted source owner ID",
+			policy:      policy,
+			claims:      GitHubClaims{RepositoryOwner: "renamed-forks", RepositoryOwnerID: "4242"},
+			targetOwner: "terrabitz",
+			want:        true,
+		},
+		{
+			name:        "Rejects a trusted source owner for another target",
+			policy:      policy,
+			claims:      GitHubClaims{RepositoryOwner: "terrabitz-forks"},
+			targetOwner: "example",
+			want:        false,
+		},
+		{
+			name:        "Rejects the reverse direction",
+			policy:      policy,
+			claims:      GitHubClaims{RepositoryOwner: "terrabitz"},
+			targetOwner: "terrabitz-forks",
+			want:        false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Allows(tt.claims, tt.targetOwner); got != tt.want {
+				t.Errorf("Allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
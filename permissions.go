@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	readOnly       = []GitHubAccessLevel{GitHubAccessLevelRead}
+	writeOnly      = []GitHubAccessLevel{GitHubAccessLevelWrite}
+	readWrite      = []GitHubAccessLevel{GitHubAccessLevelRead, GitHubAccessLevelWrite}
+	readWriteAdmin = []GitHubAccessLevel{GitHubAccessLevelRead, GitHubAccessLevelWrite, GitHubAccessLevelAdmin}
+)
+
+// PermissionCatalog lists every GitHub App permission that may be requested,
+// along with the access levels GitHub supports for it.
+var PermissionCatalog = map[string][]GitHubAccessLevel{
+	"actions":                          readWrite,
+	"administration":                   readWriteAdmin,
+	"blocking":                         readWrite,
+	"checks":                           readWrite,
+	"contents":                         readWrite,
+	"content_references":               readWrite,
+	"deployments":                      readWrite,
+	"emails":                           readWrite,
+	"environments":                     readWrite,
+	"followers":                        readWrite,
+	"issues":                           readWrite,
+	"metadata":                         readOnly,
+	"members":                          readWrite,
+	"organization_administration":      readWrite,
+	"organization_custom_roles":        readWrite,
+	"organization_hooks":               readWrite,
+	"organization_packages":            readWrite,
+	"organization_plan":                readOnly,
+	"organization_pre_receive_hooks":   readWrite,
+	"organization_projects":            readWrite,
+	"organization_secrets":             readWrite,
+	"organization_self_hosted_runners": readWrite,
+	"organization_user_blocking":       readWrite,
+	"packages":                         readWrite,
+	"pages":                            readWrite,
+	"pull_requests":                    readWrite,
+	"repository_hooks":                 readWrite,
+	"repository_projects":              readWrite,
+	"repository_pre_receive_hooks":     readWrite,
+	"secrets":                          readWrite,
+	"secret_scanning_alerts":           readWrite,
+	"security_events":                  readWrite,
+	"single_file":                      readWrite,
+	"statuses":                         readWrite,
+	"team_discussions":                 readWrite,
+	"vulnerability_alerts":             readWrite,
+	"workflows":                        writeOnly,
+}
+
+// ValidatePermission checks that a permission exists in the catalog and
+// supports the given access level.
+func ValidatePermission(permission string, accessLevel GitHubAccessLevel) error {
+	supported, ok := PermissionCatalog[permission]
+	if !ok {
+		return ErrUnknownPermission.New(
+			WithWrappedError(fmt.Errorf("'%s'", permission)),
+			WithExternalMessage(fmt.Sprintf("unknown permission '%s'", permission)),
+		)
+	}
+
+	if !Any(supported, func(level GitHubAccessLevel) bool { return level == accessLevel }) {
+		levels := Map(supported, func(level GitHubAccessLevel) string { return level.String() })
+		return ErrUnsupportedAccessLevel.New(
+			WithWrappedError(fmt.Errorf("'%s' for permission '%s'", accessLevel, permission)),
+			WithExternalMessage(fmt.Sprintf("permission '%s' does not support access level '%s'; supported levels are: %s", permission, accessLevel, strings.Join(levels, ", "))),
+		)
+	}
+
+	return nil
+}
+
+// Validate checks every permission in the set against the catalog. Permissions
+// are checked in sorted order so the reported error is deterministic.
+func (ps PermissionSet) Validate() error {
+	permissions := Keys(ps)
+	sort.Strings(permissions)
+
+	for _, permission := range permissions {
+		if err := ValidatePermission(permission, ps[permission]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPermissionSet_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		perms   PermissionSet
+		wantErr *Error
+	}{
+		{
+			name: "Accepts supported permissions and access levels",
+			perms: PermissionSet{
+				"contents":       GitHubAccessLevelWrite,
+				"metadata":       GitHubAccessLevelRead,
+				"administration": GitHubAccessLevelAdmin,
+			},
+		},
+		{
+			name: "Rejects an unknown permission",
+			perms: PermissionSet{
+				"content": GitHubAccessLevelRead,
+			},
+			wantErr: &ErrUnknownPermission,
+		},
+		{
+			name: "Rejects write on a read-only permission",
+			perms: PermissionSet{
+				"metadata": GitHubAccessLevelWrite,
+			},
+			wantErr: &ErrUnsupportedAccessLevel,
+		},
+		{
+			name: "Rejects admin outside of administration",
+			perms: PermissionSet{
+				"contents": GitHubAccessLevelAdmin,
+			},
+			wantErr: &ErrUnsupportedAccessLevel,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.perms.Validate()
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+
+			var appErr *Error
+			if !errors.As(err, &appErr) {
+				t.Fatalf("Validate() error = %v, want *Error", err)
+			}
+			if appErr.InternalMessage != tt.wantErr.InternalMessage {
+				t.Errorf("Validate() error = %v, want %v", appErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPermissionCatalog_MapsToInstallationPermissions(t *testing.T) {
+	for permission := range PermissionCatalog {
+		if _, ok := installationPermissionFields[permission]; !ok {
+			t.Errorf("permission '%s' has no GitHub equivalent", permission)
+		}
+	}
+}
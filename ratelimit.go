@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+)
+
+// RetryPolicy controls how calls to GitHub are retried when they hit a rate
+// limit or a transient server error.
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	// MaxDelay caps how long a single retry may wait. If GitHub asks us to wait
+	// longer than this, the call fails immediately instead of holding up the
+	// caller.
+	MaxDelay time.Duration
+}
+
+// RateLimitStats describes the most recently observed rate limit budget of a
+// GitHub App, along with how often the dispenser had to back off.
+type RateLimitStats struct {
+	Limit       int       `json:"limit"`
+	Remaining   int       `json:"remaining"`
+	Reset       time.Time `json:"reset"`
+	Retries     int64     `json:"retries"`
+	Exhaustions int64     `json:"exhaustions"`
+}
+
+type rateLimitTracker struct {
+	mu    sync.Mutex
+	stats RateLimitStats
+}
+
+func (t *rateLimitTracker) observe(resp *github.Response) {
+	if resp == nil || resp.Rate.Limit == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.Limit = resp.Rate.Limit
+	t.stats.Remaining = resp.Rate.Remaining
+	t.stats.Reset = resp.Rate.Reset.Time
+}
+
+func (t *rateLimitTracker) countRetry() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.Retries++
+}
+
+func (t *rateLimitTracker) countExhaustion() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.Exhaustions++
+}
+
+func (t *rateLimitTracker) Stats() RateLimitStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.stats
+}
+
+// withRetry calls fn until it succeeds, returns an error that isn't worth
+// retrying, or the retry policy gives up. Once the rate limit budget is
+// exhausted, an ErrRateLimited is returned.
+func (ghClient *GitHubAppClient) withRetry(ctx context.Context, fn func() (*github.Response, error)) error {
+	for attempt := 0; ; attempt++ {
+		resp, err := fn()
+		ghClient.rateLimits.observe(resp)
+		if err == nil {
+			return nil
+		}
+
+		delay, retryable, rateLimited := ghClient.retryDelay(err, attempt)
+		if !retryable || attempt >= ghClient.retry.MaxRetries || delay > ghClient.retry.MaxDelay {
+			if rateLimited {
+				ghClient.rateLimits.countExhaustion()
+				return ErrRateLimited.New(WithWrappedError(err))
+			}
+
+			return err
+		}
+
+		ghClient.rateLimits.countRetry()
+		if err := ghClient.sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// retryDelay works out how long to wait before retrying an error, whether it
+// should be retried at all, and whether it was caused by a rate limit.
+func (ghClient *GitHubAppClient) retryDelay(err error, attempt int) (time.Duration, bool, bool) {
+	var rateLimitErr *github.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return time.Until(rateLimitErr.Rate.Reset.Time) + jitter(ghClient.retry.BaseDelay), true, true
+	}
+
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		if abuseErr.RetryAfter != nil {
+			return *abuseErr.RetryAfter + jitter(ghClient.retry.BaseDelay), true, true
+		}
+
+		return ghClient.backoff(attempt), true, true
+	}
+
+	var ghErr *github.ErrorResponse
+	if errors.As(err, &ghErr) && ghErr.Response != nil {
+		switch ghErr.Response.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return ghClient.backoff(attempt), true, false
+		}
+	}
+
+	return 0, false, false
+}
+
+// backoff returns an exponentially increasing delay with jitter, capped at the
+// retry policy's maximum delay.
+func (ghClient *GitHubAppClient) backoff(attempt int) time.Duration {
+	delay := ghClient.retry.BaseDelay << attempt
+	if delay <= 0 || delay > ghClient.retry.MaxDelay {
+		delay = ghClient.retry.MaxDelay
+	}
+
+	return delay/2 + jitter(delay/2)
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// InstallationLimiter bounds the number of concurrent calls made on behalf of
+// each installation.
+type InstallationLimiter struct {
+	limit int
+
+	mu         sync.Mutex
+	semaphores map[int64]chan struct{}
+}
+
+func NewInstallationLimiter(limit int) *InstallationLimiter {
+	return &InstallationLimiter{
+		limit:      limit,
+		semaphores: map[int64]chan struct{}{},
+	}
+}
+
+// Acquire waits for a free slot for the installation. The returned function
+// must be called to release it. A limit of zero or less disables limiting.
+func (l *InstallationLimiter) Acquire(ctx context.Context, installationID int64) (func(), error) {
+	if l.limit <= 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	semaphore, ok := l.semaphores[installationID]
+	if !ok {
+		semaphore = make(chan struct{}, l.limit)
+		l.semaphores[installationID] = semaphore
+	}
+	l.mu.Unlock()
+
+	select {
+	case semaphore <- struct{}{}:
+		return func() { <-semaphore }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("couldn't acquire concurrency slot for installation %d: %w", installationID, ctx.Err())
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGitHubAppClient_GetInstallationToken_RetriesRateLimits(t *testing.T) {
+	attempts := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/terrabitz/foo/installation", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 1}`)
+	})
+	mux.HandleFunc("/app/installations/1/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "You have exceeded a secondary rate limit", "documentation_url": "https://docs.github.com/rest/overview/resources-in-the-rest-api#secondary-rate-limits"}`)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		fmt.Fprint(w, `{"token": "ghs_test"}`)
+	})
+
+	ghClient := newTestGitHubAppClient(t, mux)
+	repos := []Repository{{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"}}
+
+	token, err := ghClient.GetInstallationToken(context.Background(), repos, PermissionSet{"contents": GitHubAccessLevelRead})
+	if err != nil {
+		t.Fatalf("GetInstallationToken() error = %v", err)
+	}
+	if token.GetToken() != "ghs_test" {
+		t.Errorf("GetInstallationToken() = %v, want ghs_test", token.GetToken())
+	}
+
+	stats := ghClient.RateLimitStats()
+	if stats.Retries != 1 || stats.Remaining != 4999 || stats.Limit != 5000 {
+		t.Errorf("RateLimitStats() = %+v, want 1 retry and 4999/5000 remaining", stats)
+	}
+}
+
+func TestGitHubAppClient_GetInstallationToken_RateLimitExhausted(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/terrabitz/foo/installation", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message": "API rate limit exceeded"}`)
+	})
+
+	ghClient := newTestGitHubAppClient(t, mux)
+	repos := []Repository{{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"}}
+
+	_, err := ghClient.GetInstallationToken(context.Background(), repos, PermissionSet{"contents": GitHubAccessLevelRead})
+
+	var appErr *Error
+	if !errors.As(err, &appErr) || appErr.InternalMessage != ErrRateLimited.InternalMessage {
+		t.Fatalf("GetInstallationToken() error = %v, want %v", err, &ErrRateLimited)
+	}
+
+	if stats := ghClient.RateLimitStats(); stats.Exhaustions != 1 || stats.Retries != 0 {
+		t.Errorf("RateLimitStats() = %+v, want 1 exhaustion and no retries", stats)
+	}
+}
+
+func TestInstallationLimiter_Acquire(t *testing.T) {
+	limiter := NewInstallationLimiter(1)
+
+	release, err := limiter.Acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+
+	if _, err := limiter.Acquire(context.Background(), 2); err != nil {
+		t.Fatalf("Acquire() for another installation error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(ctx, 1); err == nil {
+		t.Fatal("Acquire() beyond the limit succeeded")
+	}
+
+	release()
+	if _, err := limiter.Acquire(context.Background(), 1); err != nil {
+		t.Fatalf("Acquire() after release error = %v", err)
+	}
+}
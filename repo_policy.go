@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// RepoPolicyRuleRepository serves rules that each repository defines for
+// itself, in a policy file on its default branch. The file is a list of rules
+// in the same format as the rules file:
+//
+//	# .github/token-dispenser.yaml
+//	- claims:
+//	    sub: repo:terrabitz/foo:ref:refs/heads/main
+//	  permissions:
+//	    contents: write
+//
+// If an org policy repository is configured, its policy file sets ceilings
+// for every repository of the same owner. Permissions granted by a
+// repository's own rules are capped at the ceiling of the most specific
+// matching key, and repositories without a ceiling can't grant anything.
+//
+// Policy files are cached and revalidated with their ETags, so unchanged
+// files aren't downloaded again.
+type RepoPolicyRuleRepository struct {
+	apps          *AppRegistry
+	path          string
+	orgPolicyRepo string
+	orgPolicyPath string
+	allowedClaims AllowedClaims
+	clock         Clock
+
+	repoPolicies policyFileCache[[]AuthorizationRule]
+	orgPolicies  policyFileCache[OrgPolicy]
+}
+
+func NewRepoPolicyRuleRepository(apps *AppRegistry, path, orgPolicyRepo, orgPolicyPath string, allowedClaims AllowedClaims, clock Clock) *RepoPolicyRuleRepository {
+	return &RepoPolicyRuleRepository{
+		apps:          apps,
+		path:          path,
+		orgPolicyRepo: orgPolicyRepo,
+		orgPolicyPath: orgPolicyPath,
+		allowedClaims: allowedClaims,
+		clock:         clock,
+	}
+}
+
+func (r *RepoPolicyRuleRepository) GetRulesForRepo(ctx context.Context, repo Repository) ([]AuthorizationRule, error) {
+	ghClient, err := r.apps.ClientForOwner(repo.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	source := fmt.Sprintf("%s:%s", repo.FullName, r.path)
+	rules, found, err := r.repoPolicies.Get(ctx, ghClient, repo, r.path, func(b []byte) ([]AuthorizationRule, error) {
+		rules, err := rulesFileParser{file: source, allowedClaims: r.allowedClaims}.parseRuleList(source, b)
+		if err != nil {
+			return nil, err
+		}
+
+		// Scope explicit IDs to the repository, so that a repository's policy
+		// can't pass its rules off as someone else's.
+		for i, rule := range rules {
+			if !strings.HasPrefix(rule.ID, source+"#") {
+				rules[i].ID = fmt.Sprintf("%s:%s", repo.FullName, rule.ID)
+			}
+		}
+
+		// Policy files are only parsed when they change, so expired rules
+		// are reported once per version of the file.
+		now := r.clock()
+		logExpiredRules(Filter(rules, func(rule AuthorizationRule) bool { return rule.IsExpired(now) }))
+
+		return rules, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !found || r.orgPolicyRepo == "" {
+		return rules, nil
+	}
+
+	orgPolicy, err := r.getOrgPolicy(ctx, ghClient, repo.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	ceiling, _ := orgPolicy.CeilingFor(repo)
+
+	var cappedRules []AuthorizationRule
+	for _, rule := range rules {
+		if !rule.Deny {
+			rule.Permissions = IntersectPermissions([]PermissionSet{rule.Permissions, ceiling})
+		}
+
+		cappedRules = append(cappedRules, rule)
+	}
+
+	return cappedRules, nil
+}
+
+func (r *RepoPolicyRuleRepository) getOrgPolicy(ctx context.Context, ghClient *GitHubAppClient, owner string) (OrgPolicy, error) {
+	policyRepo, err := ParseRepository(fmt.Sprintf("%s/%s", owner, r.orgPolicyRepo))
+	if err != nil {
+		return OrgPolicy{}, fmt.Errorf("invalid org policy repository: %w", err)
+	}
+
+	source := fmt.Sprintf("%s:%s", policyRepo.FullName, r.orgPolicyPath)
+	orgPolicy, found, err := r.orgPolicies.Get(ctx, ghClient, policyRepo, r.orgPolicyPath, func(b []byte) (OrgPolicy, error) {
+		return NewOrgPolicy(rulesFileParser{file: source}, b)
+	})
+	if err != nil {
+		return OrgPolicy{}, err
+	}
+
+	// Without an org policy there's nothing to cap repository policies with,
+	// so refuse to use them rather than let them grant anything.
+	if !found {
+		return OrgPolicy{}, fmt.Errorf("org policy '%s' doesn't exist", source)
+	}
+
+	return orgPolicy, nil
+}
+
+// OrgPolicy holds the permission ceilings an owner sets for its repositories.
+// Like the rules file, it's keyed by exact repository names or patterns.
+type OrgPolicy struct {
+	Ceilings map[string]PermissionSet
+
+	repoPatterns []repoKeyPattern
+}
+
+func NewOrgPolicy(p rulesFileParser, b []byte) (OrgPolicy, error) {
+	ceilings, err := p.parseCeilings(b)
+	if err != nil {
+		return OrgPolicy{}, err
+	}
+
+	patterns, err := compileRepoKeyPatterns(Keys(ceilings))
+	if err != nil {
+		return OrgPolicy{}, err
+	}
+
+	return OrgPolicy{
+		Ceilings:     ceilings,
+		repoPatterns: patterns,
+	}, nil
+}
+
+// CeilingFor returns the ceiling of the most specific key matching a
+// repository.
+func (policy OrgPolicy) CeilingFor(repo Repository) (PermissionSet, bool) {
+	if ceiling, ok := policy.Ceilings[repo.FullName]; ok {
+		return ceiling, true
+	}
+
+	for _, pattern := range policy.repoPatterns {
+		if pattern.wildcard.Matches(repo.FullName) {
+			return policy.Ceilings[pattern.key], true
+		}
+	}
+
+	return nil, false
+}
+
+// policyFileCache caches parsed policy files by repository and path, along
+// with the ETag they were served with.
+type policyFileCache[T any] struct {
+	mu    sync.Mutex
+	files map[string]cachedPolicyFile[T]
+}
+
+type cachedPolicyFile[T any] struct {
+	etag  string
+	value T
+}
+
+// Get returns a parsed policy file, and whether the file exists. Only
+// successfully parsed files are cached, so a broken file is retried on every
+// request.
+func (c *policyFileCache[T]) Get(ctx context.Context, ghClient *GitHubAppClient, repo Repository, path string, parse func([]byte) (T, error)) (T, bool, error) {
+	var zero T
+	key := fmt.Sprintf("%s:%s", repo.FullName, path)
+
+	c.mu.Lock()
+	cached, ok := c.files[key]
+	c.mu.Unlock()
+
+	file, err := ghClient.GetRepositoryFile(ctx, repo, path, cached.etag)
+	if err != nil {
+		return zero, false, err
+	}
+
+	if file.NotModified && ok {
+		return cached.value, true, nil
+	}
+
+	if file.NotFound {
+		c.mu.Lock()
+		delete(c.files, key)
+		c.mu.Unlock()
+
+		return zero, false, nil
+	}
+
+	value, err := parse(file.Content)
+	if err != nil {
+		return zero, false, err
+	}
+
+	c.mu.Lock()
+	if c.files == nil {
+		c.files = map[string]cachedPolicyFile[T]{}
+	}
+	c.files[key] = cachedPolicyFile[T]{etag: file.ETag, value: value}
+	c.mu.Unlock()
+
+	return value, true, nil
+}
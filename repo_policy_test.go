@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// fakePolicyFiles serves repository files through a fake GitHub API, honouring
+// If-None-Match and counting full downloads.
+type fakePolicyFiles struct {
+	files     map[string]string
+	downloads int
+}
+
+func (f *fakePolicyFiles) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/installation") {
+			fmt.Fprint(w, `{"id": 1}`)
+			return
+		}
+
+		content, ok := f.files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+			return
+		}
+
+		etag := fmt.Sprintf(`"%x"`, len(content))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		f.downloads++
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, content)
+	})
+	mux.HandleFunc("/app/installations/1/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"token": "ghs_reader", "expires_at": "2099-01-01T00:00:00Z"}`)
+	})
+
+	return mux
+}
+
+func newTestRepoPolicyRuleRepository(t *testing.T, files *fakePolicyFiles, orgPolicyRepo string) *RepoPolicyRuleRepository {
+	t.Helper()
+
+	ghClient := newTestGitHubAppClient(t, files.handler())
+	apps, err := NewAppRegistry([]AppConfig{{Owner: "*", AppID: 1}}, func(AppConfig) (*GitHubAppClient, error) {
+		return ghClient, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewRepoPolicyRuleRepository(apps, ".github/token-dispenser.yaml", orgPolicyRepo, "token-dispenser-org.yaml", nil, time.Now)
+}
+
+const testRepoPolicy = `
+- claims:
+    sub: repo:terrabitz/foo:*
+  permissions:
+    contents: write
+    issues: write
+- deny: true
+  claims:
+    event_name: pull_request
+  permissions:
+    contents: write
+`
+
+func TestRepoPolicyRuleRepository_GetRulesForRepo(t *testing.T) {
+	source := "terrabitz/foo:.github/token-dispenser.yaml"
+
+	tests := []struct {
+		name      string
+		files     map[string]string
+		orgPolicy string
+		want      []AuthorizationRule
+		wantErr   bool
+	}{
+		{
+			name: "Reads rules from the repository",
+			files: map[string]string{
+				"/repos/terrabitz/foo/contents/.github/token-dispenser.yaml": testRepoPolicy,
+			},
+			want: []AuthorizationRule{
+				{
+					ID:     DefaultRuleID(source, 0),
+					Source: source + ":2:3",
+					Claims: map[GitHubClaimName][]Wildcard{
+						"sub": NewWildcards("repo:terrabitz/foo:*"),
+					},
+					Permissions: PermissionSet{
+						"contents": GitHubAccessLevelWrite,
+						"issues":   GitHubAccessLevelWrite,
+					},
+				},
+				{
+					ID:     DefaultRuleID(source, 1),
+					Source: source + ":7:3",
+					Deny:   true,
+					Claims: map[GitHubClaimName][]Wildcard{
+						"event_name": NewWildcards("pull_request"),
+					},
+					Permissions: PermissionSet{
+						"contents": GitHubAccessLevelWrite,
+					},
+				},
+			},
+		},
+		{
+			name: "Scopes explicit rule IDs to the repository",
+			files: map[string]string{
+				"/repos/terrabitz/foo/contents/.github/token-dispenser.yaml": `
+- id: deploy
+  claims:
+    environment: prod
+  permissions:
+    deployments: write
+`,
+			},
+			want: []AuthorizationRule{
+				{
+					ID:     "terrabitz/foo:deploy",
+					Source: source + ":2:3",
+					Claims: map[GitHubClaimName][]Wildcard{
+						"environment": NewWildcards("prod"),
+					},
+					Permissions: PermissionSet{
+						"deployments": GitHubAccessLevelWrite,
+					},
+				},
+			},
+		},
+		{
+			name:  "Returns no rules for a repository without a policy",
+			files: map[string]string{},
+		},
+		{
+			name: "Caps allow rules at the most specific org ceiling",
+			files: map[string]string{
+				"/repos/terrabitz/foo/contents/.github/token-dispenser.yaml": testRepoPolicy,
+				"/repos/terrabitz/.github/contents/token-dispenser-org.yaml": `
+ceilings:
+  terrabitz/*:
+    contents: read
+  terrabitz/f*:
+    contents: read
+    issues: write
+`,
+			},
+			orgPolicy: ".github",
+			want: []AuthorizationRule{
+				{
+					ID:     DefaultRuleID(source, 0),
+					Source: source + ":2:3",
+					Claims: map[GitHubClaimName][]Wildcard{
+						"sub": NewWildcards("repo:terrabitz/foo:*"),
+					},
+					Permissions: PermissionSet{
+						"contents": GitHubAccessLevelRead,
+						"issues":   GitHubAccessLevelWrite,
+					},
+				},
+				{
+					ID:     DefaultRuleID(source, 1),
+					Source: source + ":7:3",
+					Deny:   true,
+					Claims: map[GitHubClaimName][]Wildcard{
+						"event_name": NewWildcards("pull_request"),
+					},
+					Permissions: PermissionSet{
+						"contents": GitHubAccessLevelWrite,
+					},
+				},
+			},
+		},
+		{
+			name: "Grants nothing to repositories without a ceiling",
+			files: map[string]string{
+				"/repos/terrabitz/foo/contents/.github/token-dispenser.yaml": `
+- claims:
+    sub: repo:terrabitz/foo:*
+  permissions:
+    contents: write
+`,
+				"/repos/terrabitz/.github/contents/token-dispenser-org.yaml": `
+ceilings:
+  terrabitz/bar:
+    contents: read
+`,
+			},
+			orgPolicy: ".github",
+			want: []AuthorizationRule{
+				{
+					ID:     DefaultRuleID(source, 0),
+					Source: source + ":2:3",
+					Claims: map[GitHubClaimName][]Wildcard{
+						"sub": NewWildcards("repo:terrabitz/foo:*"),
+					},
+					Permissions: PermissionSet{},
+				},
+			},
+		},
+		{
+			name: "Returns error when the org policy is missing",
+			files: map[string]string{
+				"/repos/terrabitz/foo/contents/.github/token-dispenser.yaml": testRepoPolicy,
+			},
+			orgPolicy: ".github",
+			wantErr:   true,
+		},
+		{
+			name: "Returns error for an invalid repository policy",
+			files: map[string]string{
+				"/repos/terrabitz/foo/contents/.github/token-dispenser.yaml": `
+- claims:
+    sub: repo:terrabitz/foo:*
+  permissions:
+    contents: owner
+`,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := &fakePolicyFiles{files: tt.files}
+			r := newTestRepoPolicyRuleRepository(t, files, tt.orgPolicy)
+
+			got, err := r.GetRulesForRepo(context.Background(), Repository{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetRulesForRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestRepoPolicyRuleRepository_RevalidatesWithETag(t *testing.T) {
+	policyPath := "/repos/terrabitz/foo/contents/.github/token-dispenser.yaml"
+	files := &fakePolicyFiles{files: map[string]string{policyPath: testRepoPolicy}}
+	r := newTestRepoPolicyRuleRepository(t, files, "")
+	repo := Repository{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"}
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.GetRulesForRepo(context.Background(), repo); err != nil {
+			t.Fatalf("GetRulesForRepo() error = %v", err)
+		}
+	}
+
+	if files.downloads != 1 {
+		t.Errorf("downloaded policy %d times, want 1", files.downloads)
+	}
+
+	files.files[policyPath] = `
+- claims:
+    sub: repo:terrabitz/foo:*
+  permissions:
+    contents: read
+`
+
+	rules, err := r.GetRulesForRepo(context.Background(), repo)
+	if err != nil {
+		t.Fatalf("GetRulesForRepo() error = %v", err)
+	}
+
+	if len(rules) != 1 || rules[0].Permissions["contents"] != GitHubAccessLevelRead {
+		t.Errorf("GetRulesForRepo() = %v, want the updated policy", rules)
+	}
+}
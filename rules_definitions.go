@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rulesDefinitions holds the named claim sets and permission presets that
+// rules refer to instead of repeating the same blocks:
+//
+//	claim_sets:
+//	  release_workflow:
+//	    job_workflow_ref: terrabitz/workflows/.github/workflows/release.yaml@*
+//	permission_presets:
+//	  release:
+//	    contents: write
+//
+//	terrabitz/foo:
+//	  - claims:
+//	      extends: release_workflow
+//	      environment: prod
+//	    permissions: release
+//
+// Definitions may extend each other, and are shared between every file that
+// is loaded together. They're resolved once and cached.
+type rulesDefinitions struct {
+	claimSets         map[string]namedDefinition
+	permissionPresets map[string]namedDefinition
+
+	resolvedClaimSets         map[string]map[GitHubClaimName][]Wildcard
+	resolvedPermissionPresets map[string]PermissionSet
+}
+
+type namedDefinition struct {
+	parser  rulesFileParser
+	keyNode *yaml.Node
+	node    *yaml.Node
+}
+
+const (
+	claimSetKind         = "claim set"
+	permissionPresetKind = "permission preset"
+)
+
+var definitionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func newRulesDefinitions() *rulesDefinitions {
+	return &rulesDefinitions{
+		claimSets:                 map[string]namedDefinition{},
+		permissionPresets:         map[string]namedDefinition{},
+		resolvedClaimSets:         map[string]map[GitHubClaimName][]Wildcard{},
+		resolvedPermissionPresets: map[string]PermissionSet{},
+	}
+}
+
+// add registers every definition in a mapping of names to definitions.
+func (defs *rulesDefinitions) add(p rulesFileParser, kind string, node *yaml.Node) error {
+	if defs == nil {
+		return p.errorf(node, "%ss aren't supported here", kind)
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return p.errorf(node, "%ss must be a mapping of names to definitions", kind)
+	}
+
+	named := defs.claimSets
+	if kind == permissionPresetKind {
+		named = defs.permissionPresets
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+
+		name := keyNode.Value
+		if !definitionNameRegexp.MatchString(name) {
+			return p.errorf(keyNode, "invalid %s name '%s'; may only contain letters, digits, '_' and '-'", kind, name)
+		}
+
+		if existing, ok := named[name]; ok {
+			return p.errorf(keyNode, "%s '%s' is already defined at %s", kind, name, existing.parser.position(existing.keyNode))
+		}
+
+		named[name] = namedDefinition{
+			parser:  p,
+			keyNode: keyNode,
+			node:    valueNode,
+		}
+	}
+
+	return nil
+}
+
+// resolveAll resolves every definition, so that broken definitions are
+// reported even if no rule refers to them.
+func (defs *rulesDefinitions) resolveAll() error {
+	for _, name := range sortedKeys(defs.claimSets) {
+		def := defs.claimSets[name]
+		if _, err := defs.resolveClaimSet(def.parser, def.keyNode, nil); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedKeys(defs.permissionPresets) {
+		def := defs.permissionPresets[name]
+		if _, err := defs.resolvePermissionPreset(def.parser, def.keyNode, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveClaimSet returns the claims of the claim set named by nameNode.
+// Errors are reported against the parser of the file the name appears in.
+func (defs *rulesDefinitions) resolveClaimSet(p rulesFileParser, nameNode *yaml.Node, stack []string) (map[GitHubClaimName][]Wildcard, error) {
+	def, err := defs.lookup(p, claimSetKind, nameNode, stack)
+	if err != nil {
+		return nil, err
+	}
+
+	name := nameNode.Value
+	claims, ok := defs.resolvedClaimSets[name]
+	if !ok {
+		claims, err = def.parser.parseClaims(fmt.Sprintf("%s '%s'", claimSetKind, name), def.node, append(stack[:len(stack):len(stack)], name))
+		if err != nil {
+			return nil, err
+		}
+
+		defs.resolvedClaimSets[name] = claims
+	}
+
+	resolved := map[GitHubClaimName][]Wildcard{}
+	for claimField, wildcards := range claims {
+		resolved[claimField] = wildcards
+	}
+
+	return resolved, nil
+}
+
+// resolvePermissionPreset returns the permissions of the preset named by
+// nameNode.
+func (defs *rulesDefinitions) resolvePermissionPreset(p rulesFileParser, nameNode *yaml.Node, stack []string) (PermissionSet, error) {
+	def, err := defs.lookup(p, permissionPresetKind, nameNode, stack)
+	if err != nil {
+		return nil, err
+	}
+
+	name := nameNode.Value
+	perms, ok := defs.resolvedPermissionPresets[name]
+	if !ok {
+		perms, err = def.parser.parsePermissions(fmt.Sprintf("%s '%s'", permissionPresetKind, name), def.node, append(stack[:len(stack):len(stack)], name))
+		if err != nil {
+			return nil, err
+		}
+
+		defs.resolvedPermissionPresets[name] = perms
+	}
+
+	resolved := PermissionSet{}
+	for permission, accessLevel := range perms {
+		resolved[permission] = accessLevel
+	}
+
+	return resolved, nil
+}
+
+func (defs *rulesDefinitions) lookup(p rulesFileParser, kind string, nameNode *yaml.Node, stack []string) (namedDefinition, error) {
+	name := nameNode.Value
+	if nameNode.Kind != yaml.ScalarNode || name == "" {
+		return namedDefinition{}, p.errorf(nameNode, "expected the name of a %s", kind)
+	}
+
+	for i, resolving := range stack {
+		if resolving == name {
+			cycle := append(stack[i:len(stack):len(stack)], name)
+			return namedDefinition{}, p.errorf(nameNode, "%s '%s' extends itself: %s", kind, name, strings.Join(cycle, " -> "))
+		}
+	}
+
+	named := map[string]namedDefinition{}
+	if defs != nil && kind == claimSetKind {
+		named = defs.claimSets
+	} else if defs != nil {
+		named = defs.permissionPresets
+	}
+
+	def, ok := named[name]
+	if !ok {
+		return namedDefinition{}, p.errorf(nameNode, "undefined %s '%s'", kind, name)
+	}
+
+	return def, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := Keys(m)
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RulesFileError reports a problem in a rules file, along with where in the
+// file it was found.
+type RulesFileError struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (err *RulesFileError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %v", err.File, err.Line, err.Column, err.Err)
+}
+
+func (err *RulesFileError) Unwrap() error {
+	return err.Err
+}
+
+// rulesFileParser turns the YAML nodes of a rules file into authorization
+// rules, rejecting anything it doesn't recognize.
+type rulesFileParser struct {
+	file string
+	// defs holds the claim sets and permission presets rules may refer to. It
+	// may be nil, in which case there are none.
+	defs *rulesDefinitions
+	// ruleIDs maps the IDs of the rules parsed so far to where they were
+	// defined, to catch duplicates. It may be shared between parsers.
+	ruleIDs map[string]string
+	// allowedClaims lists the claims rules may use besides the well-known
+	// ones.
+	allowedClaims AllowedClaims
+}
+
+func (p rulesFileParser) errorf(node *yaml.Node, format string, args ...any) error {
+	return &RulesFileError{
+		File:   p.file,
+		Line:   node.Line,
+		Column: node.Column,
+		Err:    fmt.Errorf(format, args...),
+	}
+}
+
+// position describes where a node is, in the same format as errors.
+func (p rulesFileParser) position(node *yaml.Node) string {
+	return fmt.Sprintf("%s:%d:%d", p.file, node.Line, node.Column)
+}
+
+// repoKeyRegexp matches repository keys: an owner and a name, either of which
+// may be a plain pattern using '*', '?' and '[...]', as in claim values. Since
+// every key matching a repository applies, negated, "glob:" and "re:" patterns
+// aren't supported.
+var repoKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9*?\[\]-][A-Za-z0-9*?\[\]!-]*/[A-Za-z0-9._*?\[\]!-]+$`)
+
+// rulesDocument is a single rules file, split into its sections. Named
+// definitions are registered with the parser's definitions as the document is
+// split, while repository rules are only parsed once every file has been read,
+// so that they can refer to definitions from other files.
+type rulesDocument struct {
+	parser rulesFileParser
+	// Includes lists further paths to load, relative to the file.
+	Includes   []string
+	repoKeys   []*yaml.Node
+	repoValues []*yaml.Node
+}
+
+func (p rulesFileParser) splitDocument(b []byte) (rulesDocument, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return rulesDocument{}, fmt.Errorf("couldn't parse file '%s': %w", p.file, err)
+	}
+
+	rulesDoc := rulesDocument{parser: p}
+	if len(doc.Content) == 0 {
+		return rulesDoc, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return rulesDocument{}, p.errorf(root, "rules file must be a mapping of repositories to rules")
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < len(root.Content); i += 2 {
+		keyNode, valueNode := root.Content[i], root.Content[i+1]
+
+		switch keyNode.Value {
+		case "include":
+			var includes SingleOrMulti
+			if err := valueNode.Decode(&includes); err != nil {
+				return rulesDocument{}, p.errorf(valueNode, "include must be a path or a list of paths")
+			}
+
+			rulesDoc.Includes = append(rulesDoc.Includes, includes...)
+		case "claim_sets":
+			if err := p.defs.add(p, claimSetKind, valueNode); err != nil {
+				return rulesDocument{}, err
+			}
+		case "permission_presets":
+			if err := p.defs.add(p, permissionPresetKind, valueNode); err != nil {
+				return rulesDocument{}, err
+			}
+		default:
+			if err := p.checkRepoKey(keyNode, seen[keyNode.Value]); err != nil {
+				return rulesDocument{}, err
+			}
+			seen[keyNode.Value] = true
+
+			rulesDoc.repoKeys = append(rulesDoc.repoKeys, keyNode)
+			rulesDoc.repoValues = append(rulesDoc.repoValues, valueNode)
+		}
+	}
+
+	return rulesDoc, nil
+}
+
+// parseRuleList parses a document that is just a list of rules for a single
+// repository, as found in a repository's own policy file.
+func (p rulesFileParser) parseRuleList(repo string, b []byte) ([]AuthorizationRule, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("couldn't parse file '%s': %w", p.file, err)
+	}
+
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	p.ruleIDs = map[string]string{}
+
+	return p.parseRules(repo, doc.Content[0])
+}
+
+// parseCeilings parses an org policy document, which maps repository keys to
+// the most permissions their own policies may grant:
+//
+//	ceilings:
+//	  terrabitz/*:
+//	    contents: read
+func (p rulesFileParser) parseCeilings(b []byte) (map[string]PermissionSet, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("couldn't parse file '%s': %w", p.file, err)
+	}
+
+	ceilings := map[string]PermissionSet{}
+	if len(doc.Content) == 0 {
+		return ceilings, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, p.errorf(root, "org policy must be a mapping")
+	}
+
+	for i := 0; i < len(root.Content); i += 2 {
+		keyNode, valueNode := root.Content[i], root.Content[i+1]
+		if keyNode.Value != "ceilings" {
+			return nil, p.errorf(keyNode, "unknown field '%s' in org policy", keyNode.Value)
+		}
+
+		if valueNode.Kind != yaml.MappingNode {
+			return nil, p.errorf(valueNode, "ceilings must be a mapping of repositories to permissions")
+		}
+
+		for j := 0; j < len(valueNode.Content); j += 2 {
+			repoNode, permsNode := valueNode.Content[j], valueNode.Content[j+1]
+
+			repo := repoNode.Value
+			_, seen := ceilings[repo]
+			if err := p.checkRepoKey(repoNode, seen); err != nil {
+				return nil, err
+			}
+
+			perms, err := p.parsePermissions(fmt.Sprintf("ceiling for '%s'", repo), permsNode, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			ceilings[repo] = perms
+		}
+	}
+
+	return ceilings, nil
+}
+
+func (p rulesFileParser) checkRepoKey(node *yaml.Node, seen bool) error {
+	if !repoKeyRegexp.MatchString(node.Value) {
+		return p.errorf(node, "invalid repository key '%s'; must use 'owner/name' format", node.Value)
+	}
+
+	if isGlob(node.Value) {
+		if _, err := ParseWildcard(node.Value); err != nil {
+			return p.errorf(node, "invalid repository key: %w", err)
+		}
+	}
+
+	if seen {
+		return p.errorf(node, "repository key '%s' is defined more than once", node.Value)
+	}
+
+	return nil
+}
+
+func (p rulesFileParser) parseRules(repo string, node *yaml.Node) ([]AuthorizationRule, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, p.errorf(node, "rules for '%s' must be a list", repo)
+	}
+
+	var rules []AuthorizationRule
+	for i, ruleNode := range node.Content {
+		rule, err := p.parseRule(DefaultRuleID(repo, i), ruleNode)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// ruleIDRegexp matches explicit rule IDs.
+var ruleIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._/:#@-]+$`)
+
+func (p rulesFileParser) parseRule(id string, node *yaml.Node) (AuthorizationRule, error) {
+	if node.Kind != yaml.MappingNode {
+		return AuthorizationRule{}, p.errorf(node, "rule '%s' must be a mapping", id)
+	}
+
+	// The ID is needed to report errors in the rest of the rule, so it's
+	// read first.
+	idNode := mappingValue(node, "id")
+	if idNode != nil {
+		if idNode.Kind != yaml.ScalarNode || !ruleIDRegexp.MatchString(idNode.Value) {
+			return AuthorizationRule{}, p.errorf(idNode, "invalid ID '%s' for rule '%s'; may only contain letters, digits and any of '._/:#@-'", idNode.Value, id)
+		}
+
+		id = idNode.Value
+	} else {
+		idNode = node
+	}
+
+	if source, ok := p.ruleIDs[id]; ok {
+		return AuthorizationRule{}, p.errorf(idNode, "rule ID '%s' is already used at %s", id, source)
+	}
+
+	if err := p.checkDuplicateKeys(fmt.Sprintf("rule '%s'", id), node); err != nil {
+		return AuthorizationRule{}, err
+	}
+
+	rule := AuthorizationRule{
+		ID:     id,
+		Source: p.position(node),
+		Claims: map[GitHubClaimName][]Wildcard{},
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+
+		var err error
+		switch keyNode.Value {
+		case "id":
+		case "description":
+			rule.Description, err = p.parseString(fmt.Sprintf("description of rule '%s'", id), valueNode)
+		case "owner":
+			rule.Owner, err = p.parseString(fmt.Sprintf("owner of rule '%s'", id), valueNode)
+		case "deny":
+			if err := valueNode.Decode(&rule.Deny); err != nil {
+				return AuthorizationRule{}, p.errorf(valueNode, "invalid value for 'deny' in rule '%s': must be true or false", id)
+			}
+		case "sensitive":
+			if err := valueNode.Decode(&rule.Sensitive); err != nil {
+				return AuthorizationRule{}, p.errorf(valueNode, "invalid value for 'sensitive' in rule '%s': must be true or false", id)
+			}
+		case "claims":
+			rule.Claims, err = p.parseClaims(fmt.Sprintf("rule '%s'", id), valueNode, nil)
+		case "condition":
+			rule.Condition, err = p.parseCondition(id, valueNode)
+		case "permissions":
+			rule.Permissions, err = p.parsePermissions(fmt.Sprintf("rule '%s'", id), valueNode, nil)
+		case "not_before":
+			rule.NotBefore, err = p.parseTimestamp(id, valueNode)
+		case "not_after":
+			rule.NotAfter, err = p.parseTimestamp(id, valueNode)
+		case "schedule":
+			rule.Schedule, err = p.parseSchedule(id, valueNode)
+		default:
+			err = p.errorf(keyNode, "unknown field '%s' in rule '%s'", keyNode.Value, id)
+		}
+
+		if err != nil {
+			return AuthorizationRule{}, err
+		}
+	}
+
+	if len(rule.Claims) == 0 && rule.Condition == nil {
+		return AuthorizationRule{}, p.errorf(node, "rule '%s' must have at least one claim or a condition", id)
+	}
+
+	if !rule.NotBefore.IsZero() && !rule.NotAfter.IsZero() && !rule.NotBefore.Before(rule.NotAfter) {
+		return AuthorizationRule{}, p.errorf(node, "rule '%s' must have 'not_before' before 'not_after'", id)
+	}
+
+	if p.ruleIDs != nil {
+		p.ruleIDs[id] = rule.Source
+	}
+
+	return rule, nil
+}
+
+// parseClaims parses claims, which are either the name of a claim set or a
+// mapping of claim names to values. The mapping may extend claim sets, in
+// which case its own values replace the ones it inherits for the same claim.
+// stack holds the claim sets being resolved, to detect cycles.
+func (p rulesFileParser) parseClaims(within string, node *yaml.Node, stack []string) (map[GitHubClaimName][]Wildcard, error) {
+	if node.Kind == yaml.ScalarNode {
+		return p.defs.resolveClaimSet(p, node, stack)
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return nil, p.errorf(node, "claims in %s must be a mapping or the name of a claim set", within)
+	}
+
+	if err := p.checkDuplicateKeys(fmt.Sprintf("claims in %s", within), node); err != nil {
+		return nil, err
+	}
+
+	claims := map[GitHubClaimName][]Wildcard{}
+	if extendsNode := mappingValue(node, "extends"); extendsNode != nil {
+		nameNodes, err := p.parseNames(within, extendsNode)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, nameNode := range nameNodes {
+			claimSet, err := p.defs.resolveClaimSet(p, nameNode, stack)
+			if err != nil {
+				return nil, err
+			}
+
+			for claimField, wildcards := range claimSet {
+				claims[claimField] = wildcards
+			}
+		}
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		if keyNode.Value == "extends" {
+			continue
+		}
+
+		claimField, err := NewGitHubClaimsField(keyNode.Value, p.allowedClaims)
+		if err != nil {
+			return nil, p.errorf(keyNode, "%w in %s", err, within)
+		}
+
+		var values SingleOrMulti
+		if err := valueNode.Decode(&values); err != nil {
+			return nil, p.errorf(valueNode, "claim '%s' in %s must be a string or a list of strings", claimField, within)
+		}
+
+		if len(values) == 0 {
+			return nil, p.errorf(valueNode, "claim '%s' in %s must have at least one value", claimField, within)
+		}
+
+		valueNodes := valueNode.Content
+		if valueNode.Kind == yaml.ScalarNode {
+			valueNodes = []*yaml.Node{valueNode}
+		}
+
+		var wildcards []Wildcard
+		for j, value := range values {
+			if value == "" {
+				return nil, p.errorf(valueNodes[j], "claim '%s' in %s must not have empty values", claimField, within)
+			}
+
+			wildcard, err := ParseWildcard(value)
+			if err != nil {
+				return nil, p.errorf(valueNodes[j], "invalid claim '%s' in %s: %w", claimField, within, err)
+			}
+
+			wildcards = append(wildcards, wildcard)
+		}
+
+		claims[claimField] = wildcards
+	}
+
+	return claims, nil
+}
+
+func (p rulesFileParser) parseCondition(id string, node *yaml.Node) (*Condition, error) {
+	var expression string
+	if err := node.Decode(&expression); err != nil || expression == "" {
+		return nil, p.errorf(node, "condition in rule '%s' must be a non-empty string", id)
+	}
+
+	condition, err := NewCondition(expression)
+	if err != nil {
+		return nil, p.errorf(node, "invalid condition in rule '%s': %w", id, err)
+	}
+
+	return condition, nil
+}
+
+func (p rulesFileParser) parseString(what string, node *yaml.Node) (string, error) {
+	if node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+		return "", p.errorf(node, "%s must be a string", what)
+	}
+
+	return node.Value, nil
+}
+
+func (p rulesFileParser) parseTimestamp(id string, node *yaml.Node) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, node.Value)
+	if err != nil || node.Kind != yaml.ScalarNode {
+		return time.Time{}, p.errorf(node, "invalid timestamp '%s' in rule '%s'; must use RFC 3339 format, e.g. 2024-01-31T18:00:00Z", node.Value, id)
+	}
+
+	return t, nil
+}
+
+// parseSchedule parses one schedule window or a list of them:
+//
+//	schedule:
+//	  timezone: Europe/Berlin
+//	  days: [mon, tue, wed, thu, fri]
+//	  hours: 08:00-18:00
+func (p rulesFileParser) parseSchedule(id string, node *yaml.Node) ([]ScheduleWindow, error) {
+	windowNodes := node.Content
+	if node.Kind == yaml.MappingNode {
+		windowNodes = []*yaml.Node{node}
+	} else if node.Kind != yaml.SequenceNode || len(windowNodes) == 0 {
+		return nil, p.errorf(node, "schedule in rule '%s' must be a window or a list of windows", id)
+	}
+
+	var windows []ScheduleWindow
+	for _, windowNode := range windowNodes {
+		if windowNode.Kind != yaml.MappingNode {
+			return nil, p.errorf(windowNode, "schedule window in rule '%s' must be a mapping", id)
+		}
+
+		if err := p.checkDuplicateKeys(fmt.Sprintf("schedule of rule '%s'", id), windowNode); err != nil {
+			return nil, err
+		}
+
+		window := ScheduleWindow{Location: time.UTC}
+		var hoursSet bool
+		for i := 0; i < len(windowNode.Content); i += 2 {
+			keyNode, valueNode := windowNode.Content[i], windowNode.Content[i+1]
+
+			switch keyNode.Value {
+			case "timezone":
+				location, err := time.LoadLocation(valueNode.Value)
+				if err != nil || valueNode.Value == "" {
+					return nil, p.errorf(valueNode, "invalid timezone '%s' in rule '%s'", valueNode.Value, id)
+				}
+
+				window.Location = location
+			case "days":
+				var days SingleOrMulti
+				if err := valueNode.Decode(&days); err != nil || len(days) == 0 {
+					return nil, p.errorf(valueNode, "days in rule '%s' must be a weekday or a list of weekdays", id)
+				}
+
+				for _, day := range days {
+					weekday, err := ParseWeekday(day)
+					if err != nil {
+						return nil, p.errorf(valueNode, "%w in rule '%s'", err, id)
+					}
+
+					window.Days = append(window.Days, weekday)
+				}
+			case "hours":
+				start, end, err := ParseHours(valueNode.Value)
+				if err != nil {
+					return nil, p.errorf(valueNode, "%w in rule '%s'", err, id)
+				}
+
+				window.Start, window.End = start, end
+				hoursSet = true
+			default:
+				return nil, p.errorf(keyNode, "unknown field '%s' in schedule of rule '%s'", keyNode.Value, id)
+			}
+		}
+
+		if !hoursSet {
+			window.Start, window.End = 0, 24*time.Hour
+		}
+
+		windows = append(windows, window)
+	}
+
+	return windows, nil
+}
+
+// parsePermissions parses permissions, which are either the name of a
+// permission preset or a mapping of permission names to access levels. Like
+// claims, the mapping may extend presets and override what it inherits.
+func (p rulesFileParser) parsePermissions(within string, node *yaml.Node, stack []string) (PermissionSet, error) {
+	if node.Kind == yaml.ScalarNode {
+		return p.defs.resolvePermissionPreset(p, node, stack)
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return nil, p.errorf(node, "permissions in %s must be a mapping or the name of a permission preset", within)
+	}
+
+	if err := p.checkDuplicateKeys(fmt.Sprintf("permissions in %s", within), node); err != nil {
+		return nil, err
+	}
+
+	perms := PermissionSet{}
+	if extendsNode := mappingValue(node, "extends"); extendsNode != nil {
+		nameNodes, err := p.parseNames(within, extendsNode)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, nameNode := range nameNodes {
+			preset, err := p.defs.resolvePermissionPreset(p, nameNode, stack)
+			if err != nil {
+				return nil, err
+			}
+
+			for permission, accessLevel := range preset {
+				perms[permission] = accessLevel
+			}
+		}
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		if keyNode.Value == "extends" {
+			continue
+		}
+
+		accessLevel, err := ParseGitHubAccessLevel(valueNode.Value)
+		if err != nil || valueNode.Kind != yaml.ScalarNode {
+			return nil, p.errorf(valueNode, "invalid access level '%s' for permission '%s' in %s", valueNode.Value, keyNode.Value, within)
+		}
+
+		if err := ValidatePermission(keyNode.Value, accessLevel); err != nil {
+			node := keyNode
+			if _, ok := PermissionCatalog[keyNode.Value]; ok {
+				node = valueNode
+			}
+
+			return nil, p.errorf(node, "invalid permissions in %s: %w", within, err)
+		}
+
+		perms[keyNode.Value] = accessLevel
+	}
+
+	return perms, nil
+}
+
+// parseNames parses the names listed by an extends field.
+func (p rulesFileParser) parseNames(within string, node *yaml.Node) ([]*yaml.Node, error) {
+	nameNodes := node.Content
+	if node.Kind == yaml.ScalarNode {
+		nameNodes = []*yaml.Node{node}
+	}
+
+	if node.Kind != yaml.ScalarNode && node.Kind != yaml.SequenceNode || len(nameNodes) == 0 {
+		return nil, p.errorf(node, "extends in %s must be a name or a list of names", within)
+	}
+
+	for _, nameNode := range nameNodes {
+		if nameNode.Kind != yaml.ScalarNode || nameNode.Value == "" {
+			return nil, p.errorf(nameNode, "extends in %s must be a name or a list of names", within)
+		}
+	}
+
+	return nameNodes, nil
+}
+
+// checkDuplicateKeys rejects a mapping that sets the same key more than once.
+// YAML parsers disagree on which of the values wins, so it's never what was
+// meant.
+func (p rulesFileParser) checkDuplicateKeys(within string, node *yaml.Node) error {
+	seen := map[string]bool{}
+	for i := 0; i < len(node.Content); i += 2 {
+		keyNode := node.Content[i]
+		if seen[keyNode.Value] {
+			return p.errorf(keyNode, "'%s' is set more than once in %s", keyNode.Value, within)
+		}
+
+		seen[keyNode.Value] = true
+	}
+
+	return nil
+}
+
+// mappingValue returns the value of a key in a mapping node, or nil if the key
+// isn't set.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
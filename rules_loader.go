@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadFileRuleRepository loads rules from several paths and merges them into
+// one repository. Each path may be a rules file, a directory, which is
+// searched recursively for .yaml and .yml files, or a glob such as
+// "policies/*/rules.yaml". Rules files may pull in further files with an
+// include directive, whose paths are relative to the including file:
+//
+//	include:
+//	  - teams/*.yaml
+//
+// A file reached more than once, e.g. both through a glob and an include, is
+// only loaded once. Each repository key may only be defined in one file; a key
+// defined in two places is reported with both locations, as is a rule ID
+// that's used twice. Rules may only use the well-known claims and the
+// allowed ones.
+func LoadFileRuleRepository(paths []string, allowedClaims AllowedClaims) (FileRuleRepository, error) {
+	if len(paths) == 0 {
+		return FileRuleRepository{}, fmt.Errorf("at least one rules file must be given")
+	}
+
+	loader := rulesLoader{
+		defs:          newRulesDefinitions(),
+		ruleIDs:       map[string]string{},
+		allowedClaims: allowedClaims,
+		loaded:        map[string]bool{},
+	}
+	for _, path := range paths {
+		if err := loader.loadPath(path); err != nil {
+			return FileRuleRepository{}, err
+		}
+	}
+
+	if err := loader.defs.resolveAll(); err != nil {
+		return FileRuleRepository{}, err
+	}
+
+	repoRules, err := loader.parseRepoRules()
+	if err != nil {
+		return FileRuleRepository{}, err
+	}
+
+	frr := FileRuleRepository{
+		RepoRules: repoRules,
+		files:     loader.files,
+	}
+	if err := frr.compileRepoPatterns(); err != nil {
+		return FileRuleRepository{}, err
+	}
+
+	return frr, nil
+}
+
+// rulesLoader reads rules files in two passes: the first reads every file and
+// collects their definitions, and the second parses the repository rules.
+type rulesLoader struct {
+	defs          *rulesDefinitions
+	ruleIDs       map[string]string
+	allowedClaims AllowedClaims
+	docs          []rulesDocument
+	loaded        map[string]bool
+	files         []string
+}
+
+func (l *rulesLoader) loadPath(path string) error {
+	if isGlob(path) {
+		files, err := filepath.Glob(path)
+		if err != nil {
+			return fmt.Errorf("invalid glob '%s': %w", path, err)
+		}
+
+		if len(files) == 0 {
+			return fmt.Errorf("no rules files match '%s'", path)
+		}
+
+		for _, file := range files {
+			if err := l.loadPath(file); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read file '%s': %w", path, err)
+	}
+
+	if !info.IsDir() {
+		return l.loadFile(path)
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Hidden entries are skipped, such as the timestamped directories a
+		// Kubernetes ConfigMap mount links its files into, which would
+		// otherwise be loaded a second time.
+		if file != path && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		ext := filepath.Ext(file)
+		if !d.IsDir() && (ext == ".yaml" || ext == ".yml") {
+			files = append(files, file)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't read directory '%s': %w", path, err)
+	}
+
+	for _, file := range files {
+		if err := l.loadFile(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *rulesLoader) loadFile(file string) error {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return fmt.Errorf("couldn't resolve '%s': %w", file, err)
+	}
+
+	if l.loaded[absFile] {
+		return nil
+	}
+	l.loaded[absFile] = true
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("couldn't read file '%s': %w", file, err)
+	}
+
+	doc, err := rulesFileParser{file: file, defs: l.defs, ruleIDs: l.ruleIDs, allowedClaims: l.allowedClaims}.splitDocument(b)
+	if err != nil {
+		return err
+	}
+
+	l.docs = append(l.docs, doc)
+	l.files = append(l.files, file)
+
+	for _, include := range doc.Includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(file), include)
+		}
+
+		if err := l.loadPath(include); err != nil {
+			return fmt.Errorf("couldn't load include from '%s': %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// parseRepoRules parses the repository rules of every loaded file. Each
+// repository key may only be defined once across all of the files.
+func (l *rulesLoader) parseRepoRules() (map[string][]AuthorizationRule, error) {
+	repoRules := map[string][]AuthorizationRule{}
+	keySources := map[string]string{}
+
+	for _, doc := range l.docs {
+		for i, keyNode := range doc.repoKeys {
+			key := keyNode.Value
+			if source, ok := keySources[key]; ok {
+				return nil, doc.parser.errorf(keyNode, "repository key '%s' is already defined at %s", key, source)
+			}
+
+			rules, err := doc.parser.parseRules(key, doc.repoValues[i])
+			if err != nil {
+				return nil, err
+			}
+
+			keySources[key] = doc.parser.position(keyNode)
+			repoRules[key] = rules
+		}
+	}
+
+	return repoRules, nil
+}
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestLoadFileRuleRepository(t *testing.T) {
+	tests := []struct {
+		name        string
+		paths       []string
+		wantSources map[string]string
+		wantErr     bool
+	}{
+		{
+			name:  "Loads included files",
+			paths: []string{"testdata/rules_dir/main.yaml"},
+			wantSources: map[string]string{
+				"terrabitz/*":    "testdata/rules_dir/main.yaml:5:5",
+				"terrabitz/docs": "testdata/rules_dir/teams/docs.yaml:2:5",
+				"terrabitz/foo":  "testdata/rules_dir/teams/release.yaml:2:5",
+			},
+		},
+		{
+			name:  "Loads a directory, only loading each file once",
+			paths: []string{"testdata/rules_dir"},
+			wantSources: map[string]string{
+				"terrabitz/*":    "testdata/rules_dir/main.yaml:5:5",
+				"terrabitz/docs": "testdata/rules_dir/teams/docs.yaml:2:5",
+				"terrabitz/foo":  "testdata/rules_dir/teams/release.yaml:2:5",
+			},
+		},
+		{
+			name:  "Loads files matching a glob",
+			paths: []string{"testdata/rules_dir/teams/*.yaml"},
+			wantSources: map[string]string{
+				"terrabitz/docs": "testdata/rules_dir/teams/docs.yaml:2:5",
+				"terrabitz/foo":  "testdata/rules_dir/teams/release.yaml:2:5",
+			},
+		},
+		{
+			name:  "Shares definitions between included files",
+			paths: []string{"testdata/rules_shared/main.yaml"},
+			wantSources: map[string]string{
+				"terrabitz/foo": "testdata/rules_shared/team.yaml:2:5",
+			},
+		},
+		{
+			name:    "Returns error for definitions from files that aren't loaded",
+			paths:   []string{"testdata/rules_shared/team.yaml"},
+			wantErr: true,
+		},
+		{
+			name:    "Returns error for a glob matching nothing",
+			paths:   []string{"testdata/rules_dir/*.yml"},
+			wantErr: true,
+		},
+		{
+			name:    "Returns error for no paths",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadFileRuleRepository(tt.paths, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadFileRuleRepository() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			gotSources := map[string]string{}
+			for repo, rules := range got.RepoRules {
+				for _, rule := range rules {
+					gotSources[repo] = rule.Source
+				}
+			}
+
+			if diff := deep.Equal(gotSources, tt.wantSources); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestLoadFileRuleRepository_SourceFiles(t *testing.T) {
+	frr, err := LoadFileRuleRepository([]string{"testdata/rules_dir/main.yaml"}, nil)
+	if err != nil {
+		t.Fatalf("LoadFileRuleRepository() error = %v", err)
+	}
+
+	got := frr.SourceFiles()
+	sort.Strings(got)
+
+	want := []string{
+		"testdata/rules_dir/main.yaml",
+		"testdata/rules_dir/teams/docs.yaml",
+		"testdata/rules_dir/teams/release.yaml",
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestLoadFileRuleRepository_Conflict(t *testing.T) {
+	_, err := LoadFileRuleRepository([]string{"testdata/rules_conflict"}, nil)
+
+	var fileErr *RulesFileError
+	if !errors.As(err, &fileErr) {
+		t.Fatalf("LoadFileRuleRepository() error = %v, want *RulesFileError", err)
+	}
+
+	if fileErr.File != "testdata/rules_conflict/b.yaml" || fileErr.Line != 7 {
+		t.Errorf("LoadFileRuleRepository() error = %v, want it at testdata/rules_conflict/b.yaml:7", err)
+	}
+
+	if !strings.Contains(err.Error(), "testdata/rules_conflict/a.yaml:1:1") {
+		t.Errorf("LoadFileRuleRepository() error = %v, want it to name the first definition", err)
+	}
+}
+
+// writeConfigMap lays out a rules file the way the kubelet mounts a ConfigMap:
+// the file is a symlink through the "..data" symlink into a timestamped
+// directory, and an update swaps "..data" to point at a new directory.
+func writeConfigMap(t *testing.T, dir, version, contents string) {
+	t.Helper()
+
+	versionDir := filepath.Join(dir, version)
+	if err := os.Mkdir(versionDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestRules(t, filepath.Join(versionDir, "rules.yaml"), contents)
+
+	tmpLink := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(version, tmpLink); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpLink, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "rules.yaml")
+	if _, err := os.Lstat(link); os.IsNotExist(err) {
+		if err := os.Symlink(filepath.Join("..data", "rules.yaml"), link); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadFileRuleRepository_ConfigMap(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "..2024_01_01", testRulesRead)
+
+	frr, err := LoadFileRuleRepository([]string{dir}, nil)
+	if err != nil {
+		t.Fatalf("LoadFileRuleRepository() error = %v", err)
+	}
+
+	want := []string{filepath.Join(dir, "rules.yaml")}
+	if diff := deep.Equal(frr.SourceFiles(), want); diff != nil {
+		t.Error(diff)
+	}
+}
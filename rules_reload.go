@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ReloadingRuleRepository serves rules from a repository that can be swapped
+// out while the server is running. If reloading fails, the last good rules
+// keep being served.
+type ReloadingRuleRepository struct {
+	load    func() (AuthRuleRepository, error)
+	current atomic.Pointer[AuthRuleRepository]
+
+	mu     sync.Mutex
+	status RulesStatus
+	// targets maps each file the current rules were loaded from to the file
+	// it resolves to through symlinks.
+	targets map[string]string
+}
+
+// RulesStatus describes the outcome of the most recent attempts to load rules.
+type RulesStatus struct {
+	Source      string     `json:"source"`
+	LoadedAt    time.Time  `json:"loaded_at"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// NewReloadingRuleRepository loads rules with the given function, and again on
+// every reload. The source describes where they're loaded from in the status.
+func NewReloadingRuleRepository(source string, load func() (AuthRuleRepository, error)) (*ReloadingRuleRepository, error) {
+	repo := &ReloadingRuleRepository{
+		load:   load,
+		status: RulesStatus{Source: source},
+	}
+	if err := repo.Reload(); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+func (r *ReloadingRuleRepository) GetRulesForRepo(ctx context.Context, repo Repository) ([]AuthorizationRule, error) {
+	return (*r.current.Load()).GetRulesForRepo(ctx, repo)
+}
+
+// Reload loads the rules again and swaps them in if they're valid.
+func (r *ReloadingRuleRepository) Reload() error {
+	rules, err := r.load()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.status.LastError = err.Error()
+		now := time.Now()
+		r.status.LastErrorAt = &now
+		return err
+	}
+
+	r.current.Store(&rules)
+	r.targets = resolveSymlinks(r.sourceFiles())
+	r.status.LoadedAt = time.Now()
+	r.status.LastError = ""
+
+	return nil
+}
+
+func (r *ReloadingRuleRepository) Status() RulesStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.status
+}
+
+// Watch reloads the rules whenever one of their files changes or the process
+// receives SIGHUP, until the context is cancelled. Directories are watched
+// rather than the files themselves, so that files replaced by a rename, as
+// editors do, are still picked up. A Kubernetes ConfigMap update instead swaps
+// a symlink that the files resolve through, so any change in a watched
+// directory that makes a file resolve somewhere else also triggers a reload.
+func (r *ReloadingRuleRepository) Watch(ctx context.Context, paths []string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("couldn't create file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	for _, dir := range r.watchDirs(paths) {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("couldn't watch '%s': %w", dir, err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// Writes often arrive as several events in quick succession, so wait for
+	// them to settle before reloading.
+	debounce := time.NewTimer(0)
+	<-debounce.C
+
+	reload := func() {
+		r.reloadAndLog(paths)
+
+		// Reloaded files may include files in directories that aren't being
+		// watched yet.
+		for _, dir := range r.watchDirs(paths) {
+			if err := watcher.Add(dir); err != nil {
+				fmt.Printf("couldn't watch '%s': %v\n", dir, err)
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-watcher.Events:
+			if r.isRulesFile(paths, event.Name) {
+				debounce.Reset(100 * time.Millisecond)
+			}
+		case err := <-watcher.Errors:
+			fmt.Printf("error watching rules files: %v\n", err)
+		case <-hup:
+			fmt.Println("received SIGHUP")
+			reload()
+		case <-debounce.C:
+			reload()
+		}
+	}
+}
+
+// sourceFiles returns the files the current rules were loaded from, if known.
+func (r *ReloadingRuleRepository) sourceFiles() []string {
+	if frr, ok := (*r.current.Load()).(FileRuleRepository); ok {
+		return frr.SourceFiles()
+	}
+
+	return nil
+}
+
+// watchDirs returns the directories to watch for changes to the rules: those
+// of the configured paths and of every file loaded through them.
+func (r *ReloadingRuleRepository) watchDirs(paths []string) []string {
+	var dirs []string
+	seen := map[string]bool{}
+	addDir := func(dir string) {
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, path := range paths {
+		if isGlob(path) {
+			// Watch the deepest directory that doesn't contain a wildcard.
+			prefix := path[:strings.IndexAny(path, "*?[")]
+			addDir(filepath.Dir(prefix + "x"))
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			addDir(filepath.Dir(path))
+			continue
+		}
+
+		filepath.WalkDir(path, func(dir string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+
+			// Hidden directories aren't loaded from, so there's no need to
+			// watch them.
+			if dir != path && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+
+			addDir(dir)
+
+			return nil
+		})
+	}
+
+	for _, file := range r.sourceFiles() {
+		addDir(filepath.Dir(file))
+	}
+
+	return dirs
+}
+
+// isRulesFile reports whether a changed file may hold rules, or has changed
+// where the rules files resolve to.
+func (r *ReloadingRuleRepository) isRulesFile(paths []string, file string) bool {
+	ext := filepath.Ext(file)
+	if ext == ".yaml" || ext == ".yml" {
+		return true
+	}
+
+	if Any(append(r.sourceFiles(), paths...), func(path string) bool {
+		return filepath.Clean(path) == filepath.Clean(file)
+	}) {
+		return true
+	}
+
+	r.mu.Lock()
+	targets := r.targets
+	r.mu.Unlock()
+
+	for source, target := range resolveSymlinks(r.sourceFiles()) {
+		if targets[source] != target {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveSymlinks maps files to what they resolve to through symlinks. Files
+// that can't be resolved, e.g. because they've been removed, map to "".
+func resolveSymlinks(files []string) map[string]string {
+	targets := map[string]string{}
+	for _, file := range files {
+		targets[file], _ = filepath.EvalSymlinks(file)
+	}
+
+	return targets
+}
+
+func (r *ReloadingRuleRepository) reloadAndLog(paths []string) {
+	if err := r.Reload(); err != nil {
+		fmt.Printf("couldn't reload rules from '%s'; keeping previous rules: %v\n", strings.Join(paths, ", "), err)
+		return
+	}
+
+	fmt.Printf("reloaded rules from '%s'\n", strings.Join(paths, ", "))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testRulesRead = `terrabitz/foo:
+  - permissions:
+      contents: read
+    claims:
+      sub: repo:terrabitz/*
+`
+	testRulesWrite = `terrabitz/foo:
+  - permissions:
+      contents: write
+    claims:
+      sub: repo:terrabitz/*
+`
+)
+
+func writeTestRules(t *testing.T, file string, contents string) {
+	t.Helper()
+
+	if err := os.WriteFile(file, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTestContentsAccess(t *testing.T, rules AuthRuleRepository) GitHubAccessLevel {
+	t.Helper()
+
+	got, err := rules.GetRulesForRepo(context.Background(), Repository{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"})
+	if err != nil {
+		t.Fatalf("GetRulesForRepo() error = %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("GetRulesForRepo() returned %d rules, want 1", len(got))
+	}
+
+	return got[0].Permissions["contents"]
+}
+
+func TestReloadingRuleRepository_Reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.yaml")
+	writeTestRules(t, file, testRulesRead)
+
+	rules, err := NewReloadingRuleRepository(file, func() (AuthRuleRepository, error) {
+		return NewFileRuleRepository(file)
+	})
+	if err != nil {
+		t.Fatalf("NewReloadingRuleRepository() error = %v", err)
+	}
+
+	writeTestRules(t, file, testRulesWrite)
+	if err := rules.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if got := getTestContentsAccess(t, rules); got != GitHubAccessLevelWrite {
+		t.Errorf("contents = %v after reload, want write", got)
+	}
+
+	b, err := json.Marshal(rules.Status())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status map[string]any
+	if err := json.Unmarshal(b, &status); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := status["last_error_at"]; ok {
+		t.Errorf("Status() = %s, want no last_error_at before any error", b)
+	}
+
+	writeTestRules(t, file, "terrabitz/foo: [")
+	if err := rules.Reload(); err == nil {
+		t.Fatal("Reload() of an invalid file succeeded")
+	}
+	if got := getTestContentsAccess(t, rules); got != GitHubAccessLevelWrite {
+		t.Errorf("contents = %v after invalid reload, want the last good value write", got)
+	}
+	if status := rules.Status(); status.LastError == "" || status.LastErrorAt == nil {
+		t.Error("Status() doesn't report the reload error")
+	}
+}
+
+func TestReloadingRuleRepository_Watch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.yaml")
+	writeTestRules(t, file, testRulesRead)
+
+	rules, err := NewReloadingRuleRepository(file, func() (AuthRuleRepository, error) {
+		return NewFileRuleRepository(file)
+	})
+	if err != nil {
+		t.Fatalf("NewReloadingRuleRepository() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go rules.Watch(ctx, []string{file})
+
+	// Give the watcher a moment to start before changing the file
+	time.Sleep(100 * time.Millisecond)
+	writeTestRules(t, file, testRulesWrite)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for getTestContentsAccess(t, rules) != GitHubAccessLevelWrite {
+		if time.Now().After(deadline) {
+			t.Fatal("rules weren't reloaded after the file changed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReloadingRuleRepository_Watch_ConfigMap(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "..2024_01_01", testRulesRead)
+
+	file := filepath.Join(dir, "rules.yaml")
+	rules, err := NewReloadingRuleRepository(file, func() (AuthRuleRepository, error) {
+		return NewFileRuleRepository(file)
+	})
+	if err != nil {
+		t.Fatalf("NewReloadingRuleRepository() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go rules.Watch(ctx, []string{file})
+
+	// Give the watcher a moment to start before updating the ConfigMap
+	time.Sleep(100 * time.Millisecond)
+	writeConfigMap(t, dir, "..2024_01_02", testRulesWrite)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for getTestContentsAccess(t, rules) != GitHubAccessLevelWrite {
+		if time.Now().After(deadline) {
+			t.Fatal("rules weren't reloaded after the ConfigMap was updated")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// Embed the timezone database, so that schedules work on hosts without
+	// one installed.
+	_ "time/tzdata"
+)
+
+// Clock returns the current time. Rules are evaluated against a Clock so that
+// time-bounded rules can be tested deterministically.
+type Clock func() time.Time
+
+// ScheduleWindow is a recurring window of time, such as weekdays from 08:00
+// to 18:00 in a given timezone.
+type ScheduleWindow struct {
+	Location *time.Location
+	// Days the window starts on. If empty, it starts on every day.
+	Days []time.Weekday
+	// Start and End are offsets into the day. If End is before Start, the
+	// window runs past midnight into the next day.
+	Start time.Duration
+	End   time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseWeekday parses a weekday's three-letter abbreviation, e.g. "mon".
+func ParseWeekday(s string) (time.Weekday, error) {
+	day, ok := weekdays[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid weekday '%s'; must be one of sun, mon, tue, wed, thu, fri or sat", s)
+	}
+
+	return day, nil
+}
+
+// ParseHours parses a range of hours such as "08:00-18:00" into offsets into
+// the day. The end may be "24:00" for a window that lasts until midnight.
+func ParseHours(s string) (time.Duration, time.Duration, error) {
+	startStr, endStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid hours '%s'; must use 'HH:MM-HH:MM' format", s)
+	}
+
+	start, err := parseTimeOfDay(strings.TrimSpace(startStr))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := parseTimeOfDay(strings.TrimSpace(endStr))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start == end {
+		return 0, 0, fmt.Errorf("invalid hours '%s'; must not start and end at the same time", s)
+	}
+
+	return start, end, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var hours, minutes int
+	if n, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); err != nil || n != 2 || len(s) != 5 {
+		return 0, fmt.Errorf("invalid time of day '%s'; must use 'HH:MM' format", s)
+	}
+
+	offset := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+	if hours < 0 || minutes < 0 || minutes > 59 || offset > 24*time.Hour {
+		return 0, fmt.Errorf("invalid time of day '%s'", s)
+	}
+
+	return offset, nil
+}
+
+// Contains reports whether a time falls within the window.
+func (window ScheduleWindow) Contains(t time.Time) bool {
+	local := t.In(window.Location)
+	offset := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+
+	if window.Start < window.End {
+		return offset >= window.Start && offset < window.End && window.startsOn(local.Weekday())
+	}
+
+	// The window runs past midnight, so times before its end belong to the
+	// window that started the day before.
+	if offset >= window.Start {
+		return window.startsOn(local.Weekday())
+	}
+
+	return offset < window.End && window.startsOn((local.Weekday()+6)%7)
+}
+
+func (window ScheduleWindow) startsOn(day time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+
+	return Any(window.Days, func(d time.Weekday) bool { return d == day })
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHours(t *testing.T) {
+	tests := []struct {
+		name      string
+		s         string
+		wantStart time.Duration
+		wantEnd   time.Duration
+		wantErr   bool
+	}{
+		{
+			name:      "Parses a range of hours",
+			s:         "08:00-18:30",
+			wantStart: 8 * time.Hour,
+			wantEnd:   18*time.Hour + 30*time.Minute,
+		},
+		{
+			name:      "Parses a range until midnight",
+			s:         "18:00 - 24:00",
+			wantStart: 18 * time.Hour,
+			wantEnd:   24 * time.Hour,
+		},
+		{
+			name:      "Parses a range past midnight",
+			s:         "22:00-06:00",
+			wantStart: 22 * time.Hour,
+			wantEnd:   6 * time.Hour,
+		},
+		{
+			name:    "Returns error for a missing end",
+			s:       "08:00",
+			wantErr: true,
+		},
+		{
+			name:    "Returns error for an invalid time",
+			s:       "08:00-18:60",
+			wantErr: true,
+		},
+		{
+			name:    "Returns error for a time past midnight",
+			s:       "08:00-25:00",
+			wantErr: true,
+		},
+		{
+			name:    "Returns error for an empty range",
+			s:       "08:00-08:00",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStart, gotEnd, err := ParseHours(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseHours() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if gotStart != tt.wantStart || gotEnd != tt.wantEnd {
+				t.Errorf("ParseHours() = %v, %v, want %v, %v", gotStart, gotEnd, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestScheduleWindow_Contains(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	officeHours := ScheduleWindow{
+		Location: berlin,
+		Days:     weekdays,
+		Start:    8 * time.Hour,
+		End:      18 * time.Hour,
+	}
+	nightShift := ScheduleWindow{
+		Location: time.UTC,
+		Days:     weekdays,
+		Start:    22 * time.Hour,
+		End:      6 * time.Hour,
+	}
+
+	tests := []struct {
+		name   string
+		window ScheduleWindow
+		t      string
+		want   bool
+	}{
+		{
+			name:   "Contains a time within the window",
+			window: officeHours,
+			t:      "2024-01-03T12:00:00+01:00",
+			want:   true,
+		},
+		{
+			name:   "Uses the window's timezone",
+			window: officeHours,
+			t:      "2024-01-03T07:30:00Z",
+			want:   true,
+		},
+		{
+			name:   "Excludes the end of the window",
+			window: officeHours,
+			t:      "2024-01-03T18:00:00+01:00",
+			want:   false,
+		},
+		{
+			name:   "Excludes other days",
+			window: officeHours,
+			t:      "2024-01-06T12:00:00+01:00",
+			want:   false,
+		},
+		{
+			name:   "Contains times past midnight",
+			window: nightShift,
+			t:      "2024-01-06T05:00:00Z",
+			want:   true,
+		},
+		{
+			name:   "Excludes times past midnight of windows starting on other days",
+			window: nightShift,
+			t:      "2024-01-08T05:00:00Z",
+			want:   false,
+		},
+		{
+			name:   "Excludes times between overnight windows",
+			window: nightShift,
+			t:      "2024-01-03T12:00:00Z",
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at, err := time.Parse(time.RFC3339, tt.t)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := tt.window.Contains(at); got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
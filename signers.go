@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// NewSigner returns the JWT signer for a GitHub App, based on which private key
+// source is configured for it. Exactly one source must be set.
+func NewSigner(config AppConfig) (ghinstallation.Signer, error) {
+	sources := 0
+	for _, source := range []string{config.PrivateKeyFile, config.PrivateKeyEnv, config.SigningCommand} {
+		if source != "" {
+			sources++
+		}
+	}
+
+	if sources != 1 {
+		return nil, errors.New("exactly one of a private key file, private key environment variable or signing command must be set")
+	}
+
+	switch {
+	case config.PrivateKeyFile != "":
+		return NewFileKeySigner(config.PrivateKeyFile)
+	case config.PrivateKeyEnv != "":
+		return NewEnvKeySigner(config.PrivateKeyEnv)
+	default:
+		return NewCommandSigner(config.SigningCommand)
+	}
+}
+
+func newRSASigner(privateKey []byte) (*ghinstallation.RSASigner, error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse private key: %w", err)
+	}
+
+	return ghinstallation.NewRSASigner(jwt.SigningMethodRS256, key), nil
+}
+
+// NewEnvKeySigner signs with a PEM-encoded private key held in an environment
+// variable. Since the environment can't change underneath a running process,
+// rotating the key requires a restart.
+func NewEnvKeySigner(envVar string) (*ghinstallation.RSASigner, error) {
+	privateKey, ok := os.LookupEnv(envVar)
+	if !ok {
+		return nil, fmt.Errorf("environment variable '%s' isn't set", envVar)
+	}
+
+	return newRSASigner([]byte(privateKey))
+}
+
+// FileKeySigner signs with a PEM-encoded private key read from a file. The
+// file is checked for changes before every signature, so a rotated key takes
+// effect without a restart. If the new file can't be parsed, the last good key
+// keeps being used.
+type FileKeySigner struct {
+	file string
+
+	mu      sync.Mutex
+	signer  *ghinstallation.RSASigner
+	modTime time.Time
+	size    int64
+}
+
+func NewFileKeySigner(file string) (*FileKeySigner, error) {
+	signer := &FileKeySigner{file: file}
+	if err := signer.reload(); err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+func (s *FileKeySigner) Sign(claims jwt.Claims) (string, error) {
+	s.mu.Lock()
+	if err := s.reload(); err != nil {
+		fmt.Printf("couldn't reload private key; using previous key: %v\n", err)
+	}
+	signer := s.signer
+	s.mu.Unlock()
+
+	return signer.Sign(claims)
+}
+
+// reload re-reads the key file if it has changed since it was last read.
+func (s *FileKeySigner) reload() error {
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return fmt.Errorf("couldn't stat private key file '%s': %w", s.file, err)
+	}
+
+	if s.signer != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+
+	privateKey, err := os.ReadFile(s.file)
+	if err != nil {
+		return fmt.Errorf("couldn't read private key file '%s': %w", s.file, err)
+	}
+
+	signer, err := newRSASigner(privateKey)
+	if err != nil {
+		return err
+	}
+
+	if s.signer != nil {
+		fmt.Printf("reloaded private key from '%s'\n", s.file)
+	}
+
+	s.signer = signer
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+
+	return nil
+}
+
+// ContextSigner is implemented by signers that can be bounded by the context
+// of the request they sign for.
+type ContextSigner interface {
+	SignContext(ctx context.Context, claims jwt.Claims) (string, error)
+}
+
+// AppsTransport authenticates requests as a GitHub App, like
+// ghinstallation.AppsTransport, but passes each request's context to signers
+// that accept one.
+type AppsTransport struct {
+	tr     http.RoundTripper
+	appID  int64
+	signer ghinstallation.Signer
+}
+
+func NewAppsTransport(tr http.RoundTripper, appID int64, signer ghinstallation.Signer) *AppsTransport {
+	return &AppsTransport{tr: tr, appID: appID, signer: signer}
+}
+
+func (t *AppsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// GitHub rejects fractional timestamps, so truncate them to the second.
+	iat := time.Now().Add(-30 * time.Second).Truncate(time.Second)
+	claims := &jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(iat),
+		ExpiresAt: jwt.NewNumericDate(iat.Add(2 * time.Minute)),
+		Issuer:    strconv.FormatInt(t.appID, 10),
+	}
+
+	var signed string
+	var err error
+	if signer, ok := t.signer.(ContextSigner); ok {
+		signed, err = signer.SignContext(req.Context(), claims)
+	} else {
+		signed, err = t.signer.Sign(claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't sign JWT: %w", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+signed)
+	req.Header.Add("Accept", "application/vnd.github.v3+json")
+
+	return t.tr.RoundTrip(req)
+}
+
+// signingCommandTimeout bounds a signing command whose request has no earlier
+// deadline.
+const signingCommandTimeout = 10 * time.Second
+
+// CommandSigner delegates RS256 signing to an external command, so the private
+// key never has to be loaded into this process. The command receives the JWT
+// signing input on stdin and must write the raw signature bytes to stdout,
+// e.g. `openssl dgst -sha256 -sign key.pem`.
+//
+// The command is split into arguments on whitespace; quotes and escapes aren't
+// supported, so arguments containing spaces need a wrapper script. It's killed
+// if the request it signs for is cancelled or runs past its deadline.
+type CommandSigner struct {
+	command []string
+}
+
+func NewCommandSigner(command string) (*CommandSigner, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, errors.New("signing command must not be empty")
+	}
+
+	return &CommandSigner{command: fields}, nil
+}
+
+func (s *CommandSigner) Sign(claims jwt.Claims) (string, error) {
+	return s.SignContext(context.Background(), claims)
+}
+
+func (s *CommandSigner) SignContext(ctx context.Context, claims jwt.Claims) (string, error) {
+	signingInput, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SigningString()
+	if err != nil {
+		return "", fmt.Errorf("couldn't build JWT: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, signingCommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+	cmd.Stdin = strings.NewReader(signingInput)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", fmt.Errorf("signing command didn't finish: %w", ctxErr)
+		}
+
+		return "", fmt.Errorf("signing command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if stdout.Len() == 0 {
+		return "", errors.New("signing command didn't output a signature")
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(stdout.Bytes()), nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func generateTestKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	return key, keyPEM
+}
+
+// verifiesWith reports whether a signed JWT was signed by the given key.
+func verifiesWith(t *testing.T, signed string, key *rsa.PrivateKey) bool {
+	t.Helper()
+
+	_, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+
+	return err == nil
+}
+
+func testClaims() jwt.Claims {
+	return &jwt.RegisteredClaims{
+		Issuer:    "123",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  AppConfig
+		wantErr bool
+	}{
+		{
+			name:    "Returns error if no key source is set",
+			config:  AppConfig{AppID: 1},
+			wantErr: true,
+		},
+		{
+			name: "Returns error if multiple key sources are set",
+			config: AppConfig{
+				AppID:          1,
+				PrivateKeyFile: "key.pem",
+				SigningCommand: "sign",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Returns error if the environment variable isn't set",
+			config: AppConfig{
+				AppID:         1,
+				PrivateKeyEnv: "TEST_PRIVATE_KEY_THAT_DOES_NOT_EXIST",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Creates a command signer",
+			config: AppConfig{
+				AppID:          1,
+				SigningCommand: "sign --key foo",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSigner(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewSigner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewEnvKeySigner(t *testing.T) {
+	key, keyPEM := generateTestKey(t)
+	t.Setenv("TEST_PRIVATE_KEY", string(keyPEM))
+
+	signer, err := NewEnvKeySigner("TEST_PRIVATE_KEY")
+	if err != nil {
+		t.Fatalf("NewEnvKeySigner() error = %v", err)
+	}
+
+	signed, err := signer.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	if !verifiesWith(t, signed, key) {
+		t.Error("Sign() didn't sign with the key from the environment")
+	}
+}
+
+func TestFileKeySigner_Rotation(t *testing.T) {
+	oldKey, oldPEM := generateTestKey(t)
+	newKey, newPEM := generateTestKey(t)
+
+	file := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(file, oldPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := NewFileKeySigner(file)
+	if err != nil {
+		t.Fatalf("NewFileKeySigner() error = %v", err)
+	}
+
+	signed, err := signer.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if !verifiesWith(t, signed, oldKey) {
+		t.Fatal("Sign() didn't sign with the original key")
+	}
+
+	rotate := func(contents []byte, modTime time.Time) {
+		if err := os.WriteFile(file, contents, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotate(newPEM, time.Now().Add(time.Minute))
+	signed, err = signer.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if !verifiesWith(t, signed, newKey) {
+		t.Fatal("Sign() didn't sign with the rotated key")
+	}
+
+	rotate([]byte("not a key"), time.Now().Add(2*time.Minute))
+	signed, err = signer.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if !verifiesWith(t, signed, newKey) {
+		t.Error("Sign() didn't keep the last good key after an invalid rotation")
+	}
+}
+
+func TestCommandSigner(t *testing.T) {
+	key, keyPEM := generateTestKey(t)
+
+	file := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(file, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GO_WANT_HELPER_SIGNING_COMMAND", file)
+
+	signer, err := NewCommandSigner(fmt.Sprintf("%s -test.run=TestHelperSigningCommand", os.Args[0]))
+	if err != nil {
+		t.Fatalf("NewCommandSigner() error = %v", err)
+	}
+
+	signed, err := signer.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	if !verifiesWith(t, signed, key) {
+		t.Error("Sign() didn't produce a valid signature")
+	}
+}
+
+func TestCommandSigner_SignContext_Deadline(t *testing.T) {
+	t.Setenv("GO_WANT_HELPER_SLOW_SIGNING_COMMAND", "1")
+
+	signer, err := NewCommandSigner(fmt.Sprintf("%s -test.run=TestHelperSlowSigningCommand", os.Args[0]))
+	if err != nil {
+		t.Fatalf("NewCommandSigner() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = signer.SignContext(ctx, testClaims())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SignContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("SignContext() took %v; the command wasn't killed at the deadline", elapsed)
+	}
+}
+
+type ctxKey struct{}
+
+type contextRecordingSigner struct {
+	got context.Context
+}
+
+func (s *contextRecordingSigner) Sign(claims jwt.Claims) (string, error) {
+	return "", errors.New("Sign() called instead of SignContext()")
+}
+
+func (s *contextRecordingSigner) SignContext(ctx context.Context, claims jwt.Claims) (string, error) {
+	s.got = ctx
+	return "signed", nil
+}
+
+func TestAppsTransport_PassesRequestContext(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	signer := &contextRecordingSigner{}
+	client := &http.Client{Transport: NewAppsTransport(http.DefaultTransport, 123, signer)}
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	resp.Body.Close()
+
+	if signer.got == nil || signer.got.Value(ctxKey{}) != "request" {
+		t.Error("RoundTrip() didn't sign with the request's context")
+	}
+	if authorization != "Bearer signed" {
+		t.Errorf("Authorization = %q, want %q", authorization, "Bearer signed")
+	}
+}
+
+// TestHelperSigningCommand isn't a real test; it's run as a subprocess by
+// TestCommandSigner to act as an external signing command.
+func TestHelperSigningCommand(t *testing.T) {
+	file := os.Getenv("GO_WANT_HELPER_SIGNING_COMMAND")
+	if file == "" {
+		return
+	}
+
+	keyPEM, err := os.ReadFile(file)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	signingInput, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	digest := sha256.Sum256(signingInput)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		os.Exit(1)
+	}
+
+	os.Stdout.Write(signature)
+	os.Exit(0)
+}
+
+// TestHelperSlowSigningCommand isn't a real test; it's run as a subprocess by
+// TestCommandSigner_SignContext_Deadline to act as a signing command that
+// hangs.
+func TestHelperSlowSigningCommand(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_SLOW_SIGNING_COMMAND") == "" {
+		return
+	}
+
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+)
+
+// TokenCache hands out existing installation tokens for identical requests
+// while they have at least minLifetime left before they expire. Concurrent
+// requests for the same key are collapsed into a single call to GitHub.
+//
+// Since a cached token is shared, the cache counts how many callers hold each
+// token. A token should only be revoked once the last of them releases it.
+type TokenCache struct {
+	minLifetime time.Duration
+	callTimeout time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	tokens   map[string]*github.InstallationToken
+	holds    map[string]*tokenHolds
+	inflight map[string]*tokenCacheCall
+}
+
+type tokenHolds struct {
+	count     int
+	expiresAt time.Time
+	// releasing is set while the token is being revoked, so that it isn't
+	// handed out again in the meantime.
+	releasing bool
+}
+
+type tokenCacheCall struct {
+	done  chan struct{}
+	token *github.InstallationToken
+	err   error
+}
+
+// tokenCacheCallTimeout bounds a shared call to GitHub, so that a call that
+// hangs doesn't keep every later caller for the same key waiting on it.
+const tokenCacheCallTimeout = time.Minute
+
+func NewTokenCache(minLifetime time.Duration) *TokenCache {
+	return &TokenCache{
+		minLifetime: minLifetime,
+		callTimeout: tokenCacheCallTimeout,
+		now:         time.Now,
+		tokens:      map[string]*github.InstallationToken{},
+		holds:       map[string]*tokenHolds{},
+		inflight:    map[string]*tokenCacheCall{},
+	}
+}
+
+// TokenCacheKey identifies a token by the repositories it covers and the exact
+// permissions it carries.
+func TokenCacheKey(repos []Repository, perms PermissionSet) string {
+	repoNames := Map(repos, func(repo Repository) string { return repo.FullName })
+	sort.Strings(repoNames)
+
+	var permNames []string
+	for permission, accessLevel := range perms {
+		permNames = append(permNames, fmt.Sprintf("%s=%s", permission, accessLevel))
+	}
+	sort.Strings(permNames)
+
+	return strings.Join(repoNames, ",") + "|" + strings.Join(permNames, ",")
+}
+
+// GetOrCreate returns a cached token for the key if it's still fresh enough,
+// and otherwise calls create to mint a new one. The caller holds the token
+// until it releases it.
+//
+// create runs on a context of its own, bounded by the cache's call timeout,
+// since its token is shared by every caller waiting for it; each caller only
+// stops waiting when its own ctx is done.
+func (c *TokenCache) GetOrCreate(ctx context.Context, key string, create func(context.Context) (*github.InstallationToken, error)) (*github.InstallationToken, error) {
+	c.mu.Lock()
+	c.prune()
+
+	if token, ok := c.tokens[key]; ok && !c.isReleasing(token) {
+		c.hold(token)
+		c.mu.Unlock()
+		return token, nil
+	}
+
+	call, ok := c.inflight[key]
+	if !ok {
+		call = &tokenCacheCall{done: make(chan struct{})}
+		c.inflight[key] = call
+		go c.create(key, call, create)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	c.mu.Lock()
+	c.hold(call.token)
+	c.mu.Unlock()
+
+	return call.token, nil
+}
+
+func (c *TokenCache) create(key string, call *tokenCacheCall, create func(context.Context) (*github.InstallationToken, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.callTimeout)
+	defer cancel()
+
+	call.token, call.err = create(ctx)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil && c.isFresh(call.token) {
+		c.tokens[key] = call.token
+	}
+	c.mu.Unlock()
+
+	close(call.done)
+}
+
+func (c *TokenCache) hold(token *github.InstallationToken) {
+	holds, ok := c.holds[token.GetToken()]
+	if !ok {
+		holds = &tokenHolds{expiresAt: token.GetExpiresAt().Time}
+		c.holds[token.GetToken()] = holds
+	}
+
+	holds.count++
+}
+
+func (c *TokenCache) isReleasing(token *github.InstallationToken) bool {
+	holds, ok := c.holds[token.GetToken()]
+	return ok && holds.releasing
+}
+
+// prune drops cached tokens that are no longer fresh enough to hand out, and
+// forgets the holds on tokens that have expired.
+func (c *TokenCache) prune() {
+	for key, token := range c.tokens {
+		if !c.isFresh(token) {
+			delete(c.tokens, key)
+		}
+	}
+
+	now := c.now()
+	for token, holds := range c.holds {
+		if !now.Before(holds.expiresAt) {
+			delete(c.holds, token)
+		}
+	}
+}
+
+// Release gives up one hold on a token, and reports whether it was the last
+// one, in which case the token may be revoked. Until it's either evicted or
+// restored, the token isn't handed out again.
+func (c *TokenCache) Release(token string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	holds, ok := c.holds[token]
+	if !ok {
+		return true
+	}
+
+	holds.count--
+	if holds.count > 0 {
+		return false
+	}
+
+	holds.releasing = true
+
+	return true
+}
+
+// Restore takes back a hold given up with Release, e.g. because revoking
+// the token failed.
+func (c *TokenCache) Restore(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	holds, ok := c.holds[token]
+	if !ok {
+		return
+	}
+
+	holds.count++
+	holds.releasing = false
+}
+
+func (c *TokenCache) isFresh(token *github.InstallationToken) bool {
+	return token.GetExpiresAt().Sub(c.now()) >= c.minLifetime
+}
+
+// Evict removes a token from the cache, e.g. because it has been revoked.
+func (c *TokenCache) Evict(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, cached := range c.tokens {
+		if cached.GetToken() == token {
+			delete(c.tokens, key)
+		}
+	}
+
+	delete(c.holds, token)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v53/github"
+)
+
+func TestTokenCacheKey(t *testing.T) {
+	foo := Repository{Owner: "terrabitz", Name: "foo", FullName: "terrabitz/foo"}
+	bar := Repository{Owner: "terrabitz", Name: "bar", FullName: "terrabitz/bar"}
+	perms := PermissionSet{"contents": GitHubAccessLevelRead, "issues": GitHubAccessLevelWrite}
+
+	if TokenCacheKey([]Repository{foo, bar}, perms) != TokenCacheKey([]Repository{bar, foo}, perms) {
+		t.Error("TokenCacheKey() depends on repository order")
+	}
+
+	if TokenCacheKey([]Repository{foo}, perms) == TokenCacheKey([]Repository{foo}, PermissionSet{"contents": GitHubAccessLevelRead}) {
+		t.Error("TokenCacheKey() ignores permissions")
+	}
+}
+
+func TestTokenCache_GetOrCreate(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache := NewTokenCache(30 * time.Minute)
+	cache.now = func() time.Time { return now }
+
+	var calls int
+	create := func(context.Context) (*github.InstallationToken, error) {
+		calls++
+		return &github.InstallationToken{
+			Token:     github.String("ghs_test"),
+			ExpiresAt: &github.Timestamp{Time: now.Add(time.Hour)},
+		}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetOrCreate(context.Background(), "key", create); err != nil {
+			t.Fatalf("GetOrCreate() error = %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("created %d tokens, want 1", calls)
+	}
+
+	now = now.Add(31 * time.Minute)
+	if _, err := cache.GetOrCreate(context.Background(), "key", create); err != nil {
+		t.Fatalf("GetOrCreate() error = %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("created %d tokens after minimum lifetime passed, want 2", calls)
+	}
+}
+
+func TestTokenCache_GetOrCreate_CollapsesConcurrentCalls(t *testing.T) {
+	cache := NewTokenCache(time.Minute)
+
+	var calls atomic.Int64
+	release := make(chan struct{})
+	create := func(context.Context) (*github.InstallationToken, error) {
+		calls.Add(1)
+		<-release
+		return &github.InstallationToken{
+			Token:     github.String("ghs_test"),
+			ExpiresAt: &github.Timestamp{Time: time.Now().Add(time.Hour)},
+		}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.GetOrCreate(context.Background(), "key", create); err != nil {
+				t.Errorf("GetOrCreate() error = %v", err)
+			}
+		}()
+	}
+
+	// Give every goroutine a chance to join the in-flight call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("created %d tokens, want 1", got)
+	}
+}
+
+func TestTokenCache_Evict(t *testing.T) {
+	cache := NewTokenCache(time.Minute)
+
+	var calls int
+	create := func(context.Context) (*github.InstallationToken, error) {
+		calls++
+		return &github.InstallationToken{
+			Token:     github.String("ghs_test"),
+			ExpiresAt: &github.Timestamp{Time: time.Now().Add(time.Hour)},
+		}, nil
+	}
+
+	if _, err := cache.GetOrCreate(context.Background(), "key", create); err != nil {
+		t.Fatalf("GetOrCreate() error = %v", err)
+	}
+
+	cache.Evict("ghs_test")
+
+	if _, err := cache.GetOrCreate(context.Background(), "key", create); err != nil {
+		t.Fatalf("GetOrCreate() error = %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("created %d tokens, want 2", calls)
+	}
+}
+
+func TestTokenCache_GetOrCreate_WaitersUseTheirOwnContext(t *testing.T) {
+	cache := NewTokenCache(time.Minute)
+
+	release := make(chan struct{})
+	create := func(ctx context.Context) (*github.InstallationToken, error) {
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		return &github.InstallationToken{
+			Token:     github.String("ghs_test"),
+			ExpiresAt: &github.Timestamp{Time: time.Now().Add(time.Hour)},
+		}, nil
+	}
+
+	// The first caller gives up while the token is being created
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := cache.GetOrCreate(ctx, "key", create)
+		firstErr <- err
+	}()
+
+	secondErr := make(chan error)
+	go func() {
+		_, err := cache.GetOrCreate(context.Background(), "key", create)
+		secondErr <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("GetOrCreate() error = %v for cancelled caller, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	if err := <-secondErr; err != nil {
+		t.Errorf("GetOrCreate() error = %v for waiting caller", err)
+	}
+}
+
+func TestTokenCache_Release(t *testing.T) {
+	cache := NewTokenCache(time.Minute)
+
+	var calls int
+	create := func(context.Context) (*github.InstallationToken, error) {
+		calls++
+		return &github.InstallationToken{
+			Token:     github.String("ghs_test"),
+			ExpiresAt: &github.Timestamp{Time: time.Now().Add(time.Hour)},
+		}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetOrCreate(context.Background(), "key", create); err != nil {
+			t.Fatalf("GetOrCreate() error = %v", err)
+		}
+	}
+
+	if cache.Release("ghs_test") {
+		t.Error("Release() = true while another caller still holds the token")
+	}
+
+	if !cache.Release("ghs_test") {
+		t.Error("Release() = false for the last holder")
+	}
+
+	// A token that's being revoked isn't handed out again, but stays cached
+	// in case revoking it fails
+	if _, ok := cache.tokens["key"]; !ok {
+		t.Error("Release() evicted the token before it was revoked")
+	}
+
+	if _, err := cache.GetOrCreate(context.Background(), "key", create); err != nil {
+		t.Fatalf("GetOrCreate() error = %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("created %d tokens, want 2", calls)
+	}
+}
+
+func TestTokenCache_GetOrCreate_TimesOutHungCalls(t *testing.T) {
+	cache := NewTokenCache(time.Minute)
+	cache.callTimeout = 50 * time.Millisecond
+
+	var calls atomic.Int64
+	create := func(ctx context.Context) (*github.InstallationToken, error) {
+		if calls.Add(1) == 1 {
+			// The first call hangs until its context gives up on it
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		return &github.InstallationToken{
+			Token:     github.String("ghs_test"),
+			ExpiresAt: &github.Timestamp{Time: time.Now().Add(time.Hour)},
+		}, nil
+	}
+
+	if _, err := cache.GetOrCreate(context.Background(), "key", create); err != context.DeadlineExceeded {
+		t.Fatalf("GetOrCreate() error = %v for hung call, want %v", err, context.DeadlineExceeded)
+	}
+
+	if _, err := cache.GetOrCreate(context.Background(), "key", create); err != nil {
+		t.Errorf("GetOrCreate() error = %v after a hung call timed out", err)
+	}
+}
+
+func TestTokenCache_GetOrCreate_PrunesStaleTokens(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache := NewTokenCache(30 * time.Minute)
+	cache.now = func() time.Time { return now }
+
+	create := func(context.Context) (*github.InstallationToken, error) {
+		return &github.InstallationToken{
+			Token:     github.String("ghs_test"),
+			ExpiresAt: &github.Timestamp{Time: now.Add(time.Hour)},
+		}, nil
+	}
+
+	if _, err := cache.GetOrCreate(context.Background(), "first", create); err != nil {
+		t.Fatalf("GetOrCreate() error = %v", err)
+	}
+
+	now = now.Add(31 * time.Minute)
+	if _, err := cache.GetOrCreate(context.Background(), "second", create); err != nil {
+		t.Fatalf("GetOrCreate() error = %v", err)
+	}
+
+	if _, ok := cache.tokens["first"]; ok {
+		t.Error("GetOrCreate() kept a stale token for another key")
+	}
+}
@@ -62,7 +62,7 @@ func getStringValueByJSONTag(v any, jsonTag string) (string, error) {
 	st := reflect.TypeOf(v)
 	for i := 0; i < st.NumField(); i++ {
 		field := st.Field(i)
-		if jsonField, ok := field.Tag.Lookup("json"); ok {
+		if jsonField, ok := field.Tag.Lookup("json"); ok && jsonField != "-" {
 			if jsonField == jsonTag {
 				fieldValue := val.FieldByIndex([]int{i})
 				return fieldValue.String(), nil
@@ -73,6 +73,20 @@ func getStringValueByJSONTag(v any, jsonTag string) (string, error) {
 	return "", fmt.Errorf("couldn't find element '%s'", jsonTag)
 }
 
+func getStringValuesByJSONTag(v any) map[string]string {
+	values := map[string]string{}
+
+	val := reflect.ValueOf(v)
+	st := reflect.TypeOf(v)
+	for i := 0; i < st.NumField(); i++ {
+		if jsonField, ok := st.Field(i).Tag.Lookup("json"); ok && jsonField != "-" {
+			values[jsonField] = val.Field(i).String()
+		}
+	}
+
+	return values
+}
+
 func toJson(v any) string {
 	b, _ := json.MarshalIndent(v, "", "  ")
 	return string(b)